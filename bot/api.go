@@ -0,0 +1,416 @@
+package bot
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// api is the /api/v1 REST API, it goes through the same operations as the commands (see sounds.go)
+// every guild route needs a member's session or a token for that guild (see auth.go)
+type api struct {
+	d        *discordgo.Session
+	sessions *sessionStore
+}
+
+func newAPI(d *discordgo.Session) *api {
+	return &api{d: d, sessions: newSessionStore()}
+}
+
+type apiSound struct {
+	Name string `json:"name"`
+	*Sound
+}
+
+func (a *api) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /auth/login", a.login)
+	mux.HandleFunc("GET /auth/callback", a.callback)
+	mux.HandleFunc("POST /auth/logout", a.logout)
+	mux.HandleFunc("GET /auth/me", a.me)
+
+	// the old endpoint, ?guildID= dumps the whole GuildState
+	mux.HandleFunc("GET /{$}", a.guildAuth(handleSoundList))
+
+	mux.HandleFunc("GET /api/v1/guilds/{id}/sounds", a.guildAuth(a.listSounds))
+	mux.HandleFunc("GET /api/v1/guilds/{id}/sounds/{name}", a.guildAuth(a.getSound))
+	mux.HandleFunc("PATCH /api/v1/guilds/{id}/sounds/{name}", a.guildAuth(a.updateSound))
+	mux.HandleFunc("DELETE /api/v1/guilds/{id}/sounds/{name}", a.guildAuth(a.deleteSound))
+	mux.HandleFunc("GET /api/v1/guilds/{id}/entrances", a.guildAuth(a.listEntrances))
+	mux.HandleFunc("PUT /api/v1/guilds/{id}/entrances/{userID}", a.guildAuth(a.setEntrance))
+	mux.HandleFunc("GET /api/v1/guilds/{id}/settings", a.guildAuth(a.getSettings))
+	mux.HandleFunc("PATCH /api/v1/guilds/{id}/settings", a.guildAuth(a.updateSettings))
+	mux.HandleFunc("PUT /api/v1/guilds/{id}/users/{userID}/volume", a.guildAuth(a.setUserVolume))
+	mux.HandleFunc("GET /api/v1/guilds/{id}/voice", a.guildAuth(a.voice))
+	mux.HandleFunc("GET /api/v1/guilds/{id}/events", a.guildAuth(a.streamEvents))
+	mux.HandleFunc("POST /api/v1/guilds/{id}/play", a.guildAuth(a.play))
+	mux.HandleFunc("GET /api/v1/guilds/{id}/playbacks/{playbackID}", a.guildAuth(a.playback))
+	mux.HandleFunc("GET /api/v1/guilds/{id}/export", a.guildAuth(a.export))
+	mux.HandleFunc("GET /api/v1/guilds/{id}/tokens", a.guildAuth(a.listTokens))
+	mux.HandleFunc("POST /api/v1/guilds/{id}/tokens", a.guildAuth(a.createToken))
+	mux.HandleFunc("DELETE /api/v1/guilds/{id}/tokens/{tokenID}", a.guildAuth(a.revokeToken))
+	return mux
+}
+
+// withCors answers preflight requests before they reach the method specific routes
+func withCors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enableCors(&w, r)
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *api) listSounds(w http.ResponseWriter, r *http.Request) {
+	gState, err := loadedGuild(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	sList := gState.Sounds()
+	sounds := make([]apiSound, 0, len(sList))
+	for _, name := range gState.SoundNames() {
+		if sound, ok := sList[name]; ok {
+			sounds = append(sounds, apiSound{Name: name, Sound: sound})
+		}
+	}
+	writeJSON(w, http.StatusOK, sounds)
+}
+
+func (a *api) getSound(w http.ResponseWriter, r *http.Request) {
+	gState, err := loadedGuild(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	name := r.PathValue("name")
+	sound, ok := gState.Sound(name)
+	if !ok {
+		writeError(w, r, errSoundNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, apiSound{Name: name, Sound: sound})
+}
+
+// updateSound renames a sound and/or sets its volume (in percent, null unsets it), fields left out aren't changed
+func (a *api) updateSound(w http.ResponseWriter, r *http.Request) {
+	guildID := r.PathValue("id")
+	gState, err := loadedGuild(guildID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	var body struct {
+		Name *string `json:"name"`
+		// Volume is raw so a null (unset the volume) can be told apart from leaving it out
+		Volume json.RawMessage `json:"volume"`
+	}
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	volume, err := decodeVolume(body.Volume)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	name := r.PathValue("name")
+	sound, ok := gState.Sound(name)
+	if !ok {
+		writeError(w, r, errSoundNotFound)
+		return
+	}
+	renaming := body.Name != nil && *body.Name != name
+	// everything that can be told beforehand is checked before either change, so a bad request changes nothing
+	if renaming {
+		if err := checkRename(gState, name, *body.Name); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	if err := checkVolume(volume); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if renaming {
+		sound, err = renameSound(a.d, guildID, gState, name, *body.Name)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		name = *body.Name
+	}
+
+	if len(body.Volume) > 0 {
+		sound, err = setSoundVolume(a.d, guildID, gState, name, volume)
+		if err != nil && renaming {
+			err = failed("Renamed to "+name+", but the volume couldn't be set", err)
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, apiSound{Name: name, Sound: sound})
+}
+
+func (a *api) deleteSound(w http.ResponseWriter, r *http.Request) {
+	guildID := r.PathValue("id")
+	gState, err := loadedGuild(guildID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	err = deleteSound(a.d, guildID, gState, r.PathValue("name"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listEntrances returns [UserID] -> SoundName
+func (a *api) listEntrances(w http.ResponseWriter, r *http.Request) {
+	gState, err := loadedGuild(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, gState.EntranceNames())
+}
+
+// setEntrance lets a user set their own entrance
+func (a *api) setEntrance(w http.ResponseWriter, r *http.Request) {
+	guildID := r.PathValue("id")
+	gState, err := loadedGuild(guildID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	userID := r.PathValue("userID")
+	if callerFrom(r.Context()).UserID != userID {
+		writeError(w, r, &userError{msg: "You can only set your own entrance", cause: errForbidden})
+		return
+	}
+
+	var body struct {
+		Sound string `json:"sound"`
+	}
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	sound, err := setEntrance(a.d, guildID, gState, userID, body.Sound)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, apiSound{Name: body.Sound, Sound: sound})
+}
+
+// voice returns the guild's voice channels with who's in them, and what's playing
+func (a *api) voice(w http.ResponseWriter, r *http.Request) {
+	gState, err := loadedGuild(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	current, pending := gState.Queue.Snapshot()
+	writeJSON(w, http.StatusOK, struct {
+		VoiceChannels []VoiceChannel `json:"voiceChannels"`
+		NowPlaying    *QueueItem     `json:"nowPlaying"`
+		Queue         []*QueueItem   `json:"queue"`
+	}{
+		VoiceChannels: gState.VoiceChannels(),
+		NowPlaying:    current,
+		Queue:         pending,
+	})
+}
+
+// play queues a sound, channelId is optional and defaults to the caller's voice channel and then the bot's
+// the answer has a playback ID, its status can be polled at /playbacks/{id} or followed with playback.status events
+func (a *api) play(w http.ResponseWriter, r *http.Request) {
+	guildID := r.PathValue("id")
+	gState, err := loadedGuild(guildID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	var body struct {
+		Sound     string `json:"sound"`
+		ChannelID string `json:"channelId"`
+	}
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	userID := callerFrom(r.Context()).UserID
+	channelID, err := a.playChannel(guildID, body.ChannelID, userID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	item, pos, err := queueSound(gState, body.Sound, channelID, userID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Location", "/api/v1/guilds/"+guildID+"/playbacks/"+item.ID)
+	writeJSON(w, http.StatusAccepted, struct {
+		ID        string         `json:"id"`
+		Position  int            `json:"position"`
+		Status    PlaybackStatus `json:"status"`
+		ChannelID string         `json:"channelId"`
+	}{item.ID, pos, StatusQueued, channelID})
+}
+
+// playChannel picks the voice channel to play in, see play
+func (a *api) playChannel(guildID string, channelID string, userID string) (string, error) {
+	if channelID != "" {
+		channel, err := a.d.State.Channel(channelID)
+		if err != nil || channel.GuildID != guildID {
+			return "", userErrorf("Unknown channel")
+		}
+		if channel.Type != discordgo.ChannelTypeGuildVoice && channel.Type != discordgo.ChannelTypeGuildStageVoice {
+			return "", userErrorf("That's not a voice channel")
+		}
+		return channelID, nil
+	}
+
+	if userID != "" {
+		if voiceState, err := a.d.State.VoiceState(guildID, userID); err == nil && voiceState.ChannelID != "" {
+			return voiceState.ChannelID, nil
+		}
+	}
+
+	a.d.RLock()
+	voice, ok := a.d.VoiceConnections[guildID]
+	a.d.RUnlock()
+	if ok && voice != nil {
+		voice.RLock()
+		channelID = voice.ChannelID
+		voice.RUnlock()
+		if channelID != "" {
+			return channelID, nil
+		}
+	}
+	return "", userErrorf("No voice channel to play in, pass a channelId or join one")
+}
+
+// playback returns where a sound queued with play is at
+func (a *api) playback(w http.ResponseWriter, r *http.Request) {
+	gState, err := loadedGuild(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	playback, ok := gState.Queue.Playback(r.PathValue("playbackID"))
+	if !ok {
+		writeJSON(w, http.StatusNotFound, struct {
+			Error string `json:"error"`
+		}{"Playback not found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, playback)
+}
+
+// readJSON only takes application/json bodies, a form on another site can't send those without a CORS preflight
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		writeJSON(w, http.StatusUnsupportedMediaType, struct {
+			Error string `json:"error"`
+		}{"The body has to be application/json"})
+		return false
+	}
+
+	err = json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(v)
+	if err != nil {
+		writeError(w, r, userErrorf("Invalid request body"))
+		return false
+	}
+	return true
+}
+
+// readVolume reads a {"volume": percent} body, null unsets the volume
+func readVolume(w http.ResponseWriter, r *http.Request) (*int, bool) {
+	var body struct {
+		Volume json.RawMessage `json:"volume"`
+	}
+	if !readJSON(w, r, &body) {
+		return nil, false
+	}
+	if len(body.Volume) == 0 {
+		writeError(w, r, userErrorf("Missing volume"))
+		return nil, false
+	}
+
+	volume, err := decodeVolume(body.Volume)
+	if err != nil {
+		writeError(w, r, err)
+		return nil, false
+	}
+	return volume, true
+}
+
+// decodeVolume reads a volume in percent, raw is left as json.RawMessage by callers so a null can be told apart from no value
+func decodeVolume(raw json.RawMessage) (*int, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var volume *int
+	if err := json.Unmarshal(raw, &volume); err != nil {
+		return nil, userErrorf("Volume must be a number (percent) or null")
+	}
+	return volume, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError answers with the same message a command would get, unexpected errors get logged
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusInternalServerError
+	var uErr *userError
+	switch {
+	case errors.Is(err, errUnauthorized):
+		status = http.StatusUnauthorized
+	case errors.Is(err, errForbidden):
+		status = http.StatusForbidden
+	case errors.Is(err, errGuildNotLoaded), errors.Is(err, errSoundNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, errSoundExists), errors.Is(err, errAlreadyEntrance):
+		status = http.StatusConflict
+	case errors.As(err, &uErr) && uErr.cause == nil:
+		status = http.StatusBadRequest
+	}
+
+	if !expectedError(err) {
+		logError("api request failed", err, "method", r.Method, "path", r.URL.Path)
+	}
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{userMessage(err)})
+}
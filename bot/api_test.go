@@ -0,0 +1,100 @@
+package bot
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// newTestBackend makes a bolt store with the guild's sounds the backend until the test ends
+func newTestBackend(t *testing.T, gState *GuildState) *boltStore {
+	t.Helper()
+
+	s := newTestBoltStore(t)
+	if err := s.seed(testGuildID, gState.Sounds(), make(Entrances)); err != nil {
+		t.Fatal(err)
+	}
+	previous := backend
+	backend = s
+	t.Cleanup(func() { backend = previous })
+	return s
+}
+
+func patchSound(name string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPatch, "/api/v1/guilds/guild/sounds/"+name, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.SetPathValue("id", testGuildID)
+	r.SetPathValue("name", name)
+	w := httptest.NewRecorder()
+	(&api{}).updateSound(w, r)
+	return w
+}
+
+func TestUpdateSoundChangesNothingWhenTheRenameCant(t *testing.T) {
+	gState := newTestGuild(t, 2)
+	s := newTestBackend(t, gState)
+
+	for body, want := range map[string]int{
+		`{"name": "sound1", "volume": 50}`:    http.StatusConflict,
+		`{"name": "has space", "volume": 50}`: http.StatusBadRequest,
+		`{"name": "new", "volume": 500}`:      http.StatusBadRequest,
+	} {
+		if w := patchSound("sound0", body); w.Code != want {
+			t.Errorf("PATCH %s = %d %s, want %d", body, w.Code, w.Body, want)
+		}
+	}
+
+	sList, _, err := s.load(testGuildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sounds := range []SoundList{gState.Sounds(), sList} {
+		if sound, ok := sounds["sound0"]; !ok || sound.Volume != nil || len(sounds) != 2 {
+			t.Errorf("sounds after the failed updates: %v", sounds)
+		}
+	}
+}
+
+func TestUpdateSoundRenamesAndSetsTheVolume(t *testing.T) {
+	gState := newTestGuild(t, 2)
+	s := newTestBackend(t, gState)
+
+	if w := patchSound("sound0", `{"name": "renamed", "volume": 50}`); w.Code != http.StatusOK {
+		t.Fatalf("PATCH = %d %s", w.Code, w.Body)
+	}
+
+	sList, _, err := s.load(testGuildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sounds := range []SoundList{gState.Sounds(), sList} {
+		sound, ok := sounds["renamed"]
+		if !ok || sound.Volume == nil || *sound.Volume != 50 {
+			t.Errorf("sounds after renaming and setting the volume: %v", sounds)
+		}
+	}
+}
+
+func TestUpdateSettingsOneAtATime(t *testing.T) {
+	gState := newTestGuild(t, 0)
+	s := newTestBackend(t, gState)
+
+	parallel(20, func(i int) {
+		volume := i
+		if _, err := setUserVolume(nil, testGuildID, gState, "user"+strconv.Itoa(i), &volume); err != nil {
+			t.Error(err)
+		}
+	})
+
+	saved, err := s.LoadSettings(nil, testGuildID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, settings := range []GuildSettings{gState.Settings(), saved} {
+		if len(settings.UserVolumes) != 20 {
+			t.Errorf("%d of 20 user volumes were kept: %v", len(settings.UserVolumes), settings.UserVolumes)
+		}
+	}
+}
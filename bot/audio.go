@@ -0,0 +1,250 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// uploads are probed with ffprobe/ffmpeg (which dca needs anyway) before they become sounds,
+// the loudness measured then is what Sound.gain turns into a consistent volume
+
+const (
+	// analyzeTimeout is how long probing and measuring a single file can take
+	analyzeTimeout = 2 * time.Minute
+	// silentLoudness is what ffmpeg's ebur128 reports for a file with nothing in it
+	silentLoudness = -70
+	// maxTruePeak is the highest a sound's true peak gets turned up to, so normalizing never clips
+	maxTruePeak = -1
+)
+
+// audioInfo is what an analysis found out about a file
+type audioInfo struct {
+	Duration time.Duration
+	// Loudness is the integrated loudness in LUFS, Peak the true peak in dBTP
+	Loudness float64
+	Peak     float64
+}
+
+var (
+	ebur128Loudness = regexp.MustCompile(`I:\s+(-?[\d.]+|-inf) LUFS`)
+	ebur128Peak     = regexp.MustCompile(`Peak:\s+(-?[\d.]+|-inf) dBFS`)
+)
+
+// analyzeAudio probes input (a URL or a file) and measures its loudness following EBU R128
+// files longer than config.MaxSoundDuration aren't measured, checkAudio rejects them anyway
+func analyzeAudio(ctx context.Context, input string) (audioInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, analyzeTimeout)
+	defer cancel()
+
+	var info audioInfo
+	duration, err := probeDuration(ctx, input)
+	if err != nil {
+		return info, err
+	}
+	info.Duration = duration
+	if info.Duration > time.Duration(config.MaxSoundDuration) {
+		return info, nil
+	}
+
+	var stderr bytes.Buffer
+	measure := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-nostats", "-i", input,
+		"-map", "0:a", "-af", "ebur128=peak=true:framelog=verbose", "-f", "null", "-")
+	measure.Stderr = &stderr
+	err = measure.Run()
+	if err != nil {
+		return info, fmt.Errorf("measuring loudness: %w", err)
+	}
+
+	// framelog=verbose keeps the per frame values out of the output, the last match is the summary either way
+	loudness := lastMatch(ebur128Loudness, stderr.String())
+	peak := lastMatch(ebur128Peak, stderr.String())
+	if loudness == "" || peak == "" {
+		return info, errors.New("measuring loudness: no summary in ffmpeg's output")
+	}
+	info.Loudness = parseLevel(loudness)
+	info.Peak = parseLevel(peak)
+	return info, nil
+}
+
+// probeDuration asks ffprobe how long input is
+func probeDuration(ctx context.Context, input string) (time.Duration, error) {
+	out, err := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1", input).Output()
+	if err != nil {
+		return 0, fmt.Errorf("probing audio: %w", err)
+	}
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil {
+		return 0, fmt.Errorf("probing audio: no duration: %q", out)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// analyzeData analyzes a file that's only in memory (a zip entry), ffprobe needs to seek so it goes to a temp file
+func analyzeData(ctx context.Context, data []byte, format string) (audioInfo, error) {
+	tmp, err := os.CreateTemp("", "ebening-*."+format)
+	if err != nil {
+		return audioInfo{}, err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	closeErr := tmp.Close()
+	if err = errors.Join(err, closeErr); err != nil {
+		return audioInfo{}, err
+	}
+	return analyzeAudio(ctx, tmp.Name())
+}
+
+func lastMatch(re *regexp.Regexp, s string) string {
+	matches := re.FindAllStringSubmatch(s, -1)
+	if len(matches) == 0 {
+		return ""
+	}
+	return matches[len(matches)-1][1]
+}
+
+func parseLevel(level string) float64 {
+	value, err := strconv.ParseFloat(level, 64)
+	if err != nil || value < silentLoudness {
+		return silentLoudness
+	}
+	return value
+}
+
+// checkSize rejects an upload before it's downloaded to be analyzed
+func checkSize(size int) error {
+	if size > config.MaxSoundSizeMB<<20 {
+		return userErrorf("it's %.1f MB, sounds can be up to %d MB", float64(size)/(1<<20), config.MaxSoundSizeMB)
+	}
+	return nil
+}
+
+// checkAudio is the reason an analyzed upload can't be a sound, nil if it can
+func checkAudio(info audioInfo) error {
+	maxDuration := time.Duration(config.MaxSoundDuration)
+	switch {
+	case info.Duration > maxDuration:
+		return userErrorf("it's %s long, sounds can be up to %s", info.Duration.Round(time.Second), maxDuration)
+	case info.Loudness <= silentLoudness:
+		return userErrorf("it's silent")
+	}
+	return nil
+}
+
+// validateUpload analyzes a file uploaded to the sounds channel, the error is why it can't be a sound
+func validateUpload(attachment *discordgo.MessageAttachment) (audioInfo, error) {
+	err := checkSize(attachment.Size)
+	if err != nil {
+		return audioInfo{}, err
+	}
+
+	info, err := analyzeAudio(context.Background(), attachment.URL)
+	if err != nil {
+		return info, &userError{msg: "it couldn't be read as audio", cause: err}
+	}
+	return info, checkAudio(info)
+}
+
+// rejectUpload tells the uploader why their file isn't a sound and deletes it,
+// a message with other files in it stays so they aren't lost too
+func rejectUpload(d *discordgo.Session, uMsg *discordgo.MessageCreate, attachment *discordgo.MessageAttachment, reason error) {
+	if !expectedError(reason) {
+		logError("analyzing upload", reason, "guild", uMsg.GuildID, "file", attachment.Filename)
+	}
+
+	_, err := d.ChannelMessageSendReply(uMsg.ChannelID, attachment.Filename+" was rejected, "+userMessage(reason), uMsg.Reference())
+	if err != nil {
+		logError("sending rejected upload reply", err, "guild", uMsg.GuildID)
+	}
+	if len(uMsg.Attachments) > 1 {
+		return
+	}
+	err = d.ChannelMessageDelete(uMsg.ChannelID, uMsg.ID)
+	if err != nil {
+		logError("deleting rejected upload", err, "guild", uMsg.GuildID, "message", uMsg.ID)
+	}
+}
+
+// gain is how many dB the sound is turned up or down to play at config.TargetLoudness,
+// capped so its peak stays under maxTruePeak. Sounds that were never measured play as they are
+func (s *Sound) gain() float64 {
+	if !config.Normalize || s.Loudness == 0 {
+		return 0
+	}
+	return min(config.TargetLoudness-s.Loudness, maxTruePeak-s.Peak)
+}
+
+const (
+	// defaultVolume is what a sound whose volume was never set plays at, in percent of the file
+	defaultVolume = 100
+	maxVolume     = 200
+)
+
+// volume is the sound's volume in percent
+func (s *Sound) volume() int {
+	if s.Volume == nil {
+		return defaultVolume
+	}
+	return *s.Volume
+}
+
+// volumeFilter is the ffmpeg filter that plays the sound at its volume and gain times scale (see GuildSettings.volumeScale),
+// it's what stands in for dca's volume option (256ths of the original, up to 2x) which isn't enough for quiet sounds
+func (s *Sound) volumeFilter(scale float64) string {
+	return fmt.Sprintf("volume=%.4f", float64(s.volume())/100*scale*math.Pow(10, s.gain()/20))
+}
+
+// sameVolume is true when both volumes are unset or set to the same percent
+func sameVolume(a *int, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// measuring [MessageID] are sounds being measured in the background, see measureLater
+var measuring sync.Map
+
+// measureLater measures a sound that was loaded without its loudness (uploaded before it was tracked,
+// or a user upload after a restart) so it's normalized from the next time it plays
+func measureLater(d *discordgo.Session, guildID string, name string, sound *Sound) {
+	if !config.Normalize || sound.Loudness != 0 {
+		return
+	}
+	if _, running := measuring.LoadOrStore(sound.MessageID, struct{}{}); running {
+		return
+	}
+
+	go func() {
+		defer measuring.Delete(sound.MessageID)
+
+		err := callRecovered(func() error {
+			gState, err := loadedGuild(guildID)
+			if err != nil {
+				return err
+			}
+			info, err := analyzeAudio(context.Background(), freshSound(d, gState, sound).URL)
+			if err != nil {
+				return err
+			}
+			_, err = setSoundLoudness(d, guildID, gState, name, sound.MessageID, info)
+			return err
+		})
+		if err != nil && !errors.Is(err, errSoundNotFound) {
+			logError("measuring sound", err, "guild", guildID, "sound", name)
+		}
+	}()
+}
@@ -0,0 +1,546 @@
+package bot
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	sessionCookie    = "ebening_session"
+	oauthStateCookie = "ebening_oauth_state"
+	sessionTTL       = 7 * 24 * time.Hour
+	// membershipTTL is how long a confirmed guild membership is trusted before asking discord again
+	membershipTTL = 5 * time.Minute
+	// apiTokenTTL is how long an API token works, a new one has to be made after that
+	apiTokenTTL = 90 * 24 * time.Hour
+	// maxAPITokens keeps a guild's tokens small enough for the settings message (see metadata.Settings)
+	maxAPITokens = 10
+)
+
+var (
+	errUnauthorized = errors.New("not logged in")
+	errForbidden    = errors.New("not a member of this guild")
+)
+
+// caller is who made an API request, a token caller acts as the member who created the token
+// and goes through the same permission checks that member would
+type caller struct {
+	UserID string
+	Token  bool
+}
+
+type callerKey struct{}
+
+func callerFrom(ctx context.Context) caller {
+	c, _ := ctx.Value(callerKey{}).(caller)
+	return c
+}
+
+type authSession struct {
+	UserID   string
+	Username string
+	expires  time.Time
+
+	mu sync.Mutex
+	// members [GuildID] is when the user was last confirmed to be in the guild
+	members map[string]time.Time
+}
+
+// sessionStore keeps sessions in memory, a restart logs everyone out
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*authSession
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{sessions: make(map[string]*authSession)}
+}
+
+func (s *sessionStore) create(userID string, username string) (string, error) {
+	id, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for sessionID, session := range s.sessions {
+		if now.After(session.expires) {
+			delete(s.sessions, sessionID)
+		}
+	}
+	s.sessions[id] = &authSession{
+		UserID:   userID,
+		Username: username,
+		expires:  now.Add(sessionTTL),
+		members:  make(map[string]time.Time),
+	}
+	return id, nil
+}
+
+func (s *sessionStore) get(id string) (*authSession, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok || time.Now().After(session.expires) {
+		delete(s.sessions, id)
+		return nil, false
+	}
+	return session, true
+}
+
+func (s *sessionStore) delete(id string) {
+	s.mu.Lock()
+	delete(s.sessions, id)
+	s.mu.Unlock()
+}
+
+// requestSession returns the session in the request's cookie
+func (a *api) requestSession(r *http.Request) (string, *authSession, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", nil, false
+	}
+	session, ok := a.sessions.get(cookie.Value)
+	return cookie.Value, session, ok
+}
+
+// guildAuth only lets the request through if it carries a token for the guild or a session of one of its members
+// the guild comes from the {id} path value, or the guildID query parameter for the old endpoint
+func (a *api) guildAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		guildID := r.PathValue("id")
+		if guildID == "" {
+			guildID = r.URL.Query().Get("guildID")
+		}
+
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			tokenGuildID, tokenID, valid := parseAPIToken(token)
+			if !valid {
+				writeError(w, r, errUnauthorized)
+				return
+			}
+			if tokenGuildID != guildID {
+				writeError(w, r, errForbidden)
+				return
+			}
+			gState, ok := store.Guild(guildID)
+			if !ok {
+				writeError(w, r, errForbidden)
+				return
+			}
+			// a token that was revoked (or never saved) isn't in the settings anymore
+			stored, ok := gState.Settings().Tokens[tokenID]
+			if !ok || time.Now().After(stored.Expires) {
+				writeError(w, r, errUnauthorized)
+				return
+			}
+			next(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, caller{UserID: stored.CreatedBy, Token: true})))
+			return
+		}
+
+		_, session, ok := a.requestSession(r)
+		if !ok {
+			writeError(w, r, errUnauthorized)
+			return
+		}
+
+		err := a.checkMembership(session, guildID)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, caller{UserID: session.UserID})))
+	}
+}
+
+// checkMembership asks the bot's state (or discord) whether the session's user is in the guild
+func (a *api) checkMembership(session *authSession, guildID string) error {
+	if _, ok := store.Guild(guildID); !ok {
+		return errForbidden
+	}
+
+	session.mu.Lock()
+	confirmed, ok := session.members[guildID]
+	session.mu.Unlock()
+	if ok && time.Since(confirmed) < membershipTTL {
+		return nil
+	}
+
+	if _, err := a.d.State.Member(guildID, session.UserID); err != nil {
+		_, err = a.d.GuildMember(guildID, session.UserID)
+		var restErr *discordgo.RESTError
+		if errors.As(err, &restErr) && restErr.Response != nil && restErr.Response.StatusCode == http.StatusNotFound {
+			return errForbidden
+		}
+		if err != nil {
+			return fmt.Errorf("checking guild membership: %w", err)
+		}
+	}
+
+	session.mu.Lock()
+	session.members[guildID] = time.Now()
+	session.mu.Unlock()
+	return nil
+}
+
+// login sends the user to discord's consent screen, identify is the only scope needed since membership is checked by the bot
+func (a *api) login(w http.ResponseWriter, r *http.Request) {
+	if config.OAuthClientID == "" || config.OAuthClientSecret == "" || config.OAuthRedirectURL == "" {
+		http.Error(w, "Login is not configured", http.StatusNotImplemented)
+		return
+	}
+
+	state, err := randomString(16)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	http.SetCookie(w, authCookie(oauthStateCookie, state, 10*time.Minute))
+
+	query := url.Values{
+		"client_id":     {config.OAuthClientID},
+		"redirect_uri":  {config.OAuthRedirectURL},
+		"response_type": {"code"},
+		"scope":         {"identify"},
+		"state":         {state},
+	}
+	http.Redirect(w, r, "https://discord.com/oauth2/authorize?"+query.Encode(), http.StatusFound)
+}
+
+func (a *api) callback(w http.ResponseWriter, r *http.Request) {
+	stateCookie, err := r.Cookie(oauthStateCookie)
+	state := r.URL.Query().Get("state")
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(stateCookie.Value), []byte(state)) != 1 {
+		http.Error(w, "Invalid login state, try logging in again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, authCookie(oauthStateCookie, "", -1))
+
+	code := r.URL.Query().Get("code")
+	if code == "" {
+		http.Error(w, "Login was cancelled", http.StatusBadRequest)
+		return
+	}
+
+	accessToken, err := exchangeCode(r.Context(), code)
+	if err != nil {
+		writeError(w, r, failed("Login failed", err))
+		return
+	}
+
+	userSession, err := discordgo.New("Bearer " + accessToken)
+	if err != nil {
+		writeError(w, r, failed("Login failed", err))
+		return
+	}
+	user, err := userSession.User("@me")
+	if err != nil {
+		writeError(w, r, failed("Login failed", err))
+		return
+	}
+
+	sessionID, err := a.sessions.create(user.ID, user.Username)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	http.SetCookie(w, authCookie(sessionCookie, sessionID, sessionTTL))
+
+	redirect := config.FrontendURL
+	if redirect == "" {
+		redirect = "/"
+	}
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+func (a *api) logout(w http.ResponseWriter, r *http.Request) {
+	if sessionID, _, ok := a.requestSession(r); ok {
+		a.sessions.delete(sessionID)
+	}
+	http.SetCookie(w, authCookie(sessionCookie, "", -1))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// me returns the logged in user and the guilds they share with the bot
+func (a *api) me(w http.ResponseWriter, r *http.Request) {
+	_, session, ok := a.requestSession(r)
+	if !ok {
+		writeError(w, r, errUnauthorized)
+		return
+	}
+
+	guildIDs := []string{}
+	for _, guildID := range store.GuildIDs() {
+		if a.checkMembership(session, guildID) == nil {
+			guildIDs = append(guildIDs, guildID)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		UserID   string   `json:"userId"`
+		Username string   `json:"username"`
+		Guilds   []string `json:"guilds"`
+	}{session.UserID, session.Username, guildIDs})
+}
+
+// apiToken is what's kept about an API token, the token itself is signed (see newAPIToken) so only its ID is stored
+type apiToken struct {
+	CreatedBy string    `json:"createdBy"`
+	Expires   time.Time `json:"expires"`
+}
+
+// createToken mints an API token for the guild, only members who can manage the server can, and only logged in
+// (a token can't make more tokens). The token is only shown this once
+func (a *api) createToken(w http.ResponseWriter, r *http.Request) {
+	c := callerFrom(r.Context())
+	if c.Token {
+		writeError(w, r, errForbidden)
+		return
+	}
+	if config.APITokenSecret == "" {
+		writeError(w, r, userErrorf("API tokens are not configured"))
+		return
+	}
+
+	guildID := r.PathValue("id")
+	gState, err := loadedGuild(guildID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if !canManageGuild(a.d, c.UserID, gState) {
+		writeError(w, r, &userError{msg: "Only members who can manage the server can create tokens", cause: errForbidden})
+		return
+	}
+
+	var tokenID, token string
+	var stored apiToken
+	_, err = updateSettings(a.d, guildID, gState, func(settings *GuildSettings) error {
+		now := time.Now()
+		for tokenID, stored := range settings.Tokens {
+			if now.After(stored.Expires) {
+				delete(settings.Tokens, tokenID)
+			}
+		}
+		if len(settings.Tokens) >= maxAPITokens {
+			return userErrorf("The guild already has %d tokens, revoke one first", maxAPITokens)
+		}
+
+		var err error
+		tokenID, token, err = newAPIToken(guildID)
+		if err != nil {
+			return err
+		}
+		stored = apiToken{CreatedBy: c.UserID, Expires: now.Add(apiTokenTTL).Truncate(time.Second)}
+		settings.Tokens[tokenID] = stored
+		return nil
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, struct {
+		ID      string    `json:"id"`
+		Token   string    `json:"token"`
+		Expires time.Time `json:"expires"`
+	}{tokenID, token, stored.Expires})
+}
+
+// listTokens returns the guild's tokens (not the tokens themselves, they're only shown when they're made)
+func (a *api) listTokens(w http.ResponseWriter, r *http.Request) {
+	gState, err := loadedGuild(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if !canManageGuild(a.d, callerFrom(r.Context()).UserID, gState) {
+		writeError(w, r, &userError{msg: "Only members who can manage the server can see tokens", cause: errForbidden})
+		return
+	}
+
+	type listedToken struct {
+		ID string `json:"id"`
+		apiToken
+	}
+	tokens := []listedToken{}
+	for tokenID, stored := range gState.Settings().Tokens {
+		tokens = append(tokens, listedToken{tokenID, stored})
+	}
+	slices.SortFunc(tokens, func(a, b listedToken) int { return a.Expires.Compare(b.Expires) })
+	writeJSON(w, http.StatusOK, tokens)
+}
+
+// revokeToken deletes a token, members who can manage the server can revoke any, everyone else only their own
+func (a *api) revokeToken(w http.ResponseWriter, r *http.Request) {
+	guildID := r.PathValue("id")
+	gState, err := loadedGuild(guildID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	tokenID := r.PathValue("tokenID")
+	stored, ok := gState.Settings().Tokens[tokenID]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, struct {
+			Error string `json:"error"`
+		}{"Token not found"})
+		return
+	}
+	if c := callerFrom(r.Context()); c.UserID != stored.CreatedBy && !canManageGuild(a.d, c.UserID, gState) {
+		writeError(w, r, &userError{msg: "Only members who can manage the server can revoke other people's tokens", cause: errForbidden})
+		return
+	}
+
+	_, err = updateSettings(a.d, guildID, gState, func(settings *GuildSettings) error {
+		delete(settings.Tokens, tokenID)
+		return nil
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// canManageGuild is true for members with the Manage Server permission (or admins), always checked in the sounds
+// channel so commands (typed anywhere) and the API agree
+func canManageGuild(d *discordgo.Session, userID string, gState *GuildState) bool {
+	return hasPermission(d, userID, gState.SoundsChannelID(), discordgo.PermissionManageServer)
+}
+
+// hasPermission is true for members with any of permissions in channelID, admins have them all
+func hasPermission(d *discordgo.Session, userID string, channelID string, permissions int64) bool {
+	if userID == "" || channelID == "" {
+		return false
+	}
+	granted, err := d.UserChannelPermissions(userID, channelID)
+	if err != nil {
+		logError("getting permissions", err, "user", userID, "channel", channelID)
+		return false
+	}
+	return granted&(permissions|discordgo.PermissionAdministrator) != 0
+}
+
+func exchangeCode(ctx context.Context, code string) (string, error) {
+	form := url.Values{
+		"client_id":     {config.OAuthClientID},
+		"client_secret": {config.OAuthClientSecret},
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {config.OAuthRedirectURL},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discordgo.EndpointOAuth2+"token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token exchange: %s", resp.Status)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return "", err
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("token exchange: no access token")
+	}
+	return token.AccessToken, nil
+}
+
+// API tokens are "<guildID>.<tokenID>.<signature>", only the ID is stored (in the guild's settings) so it can
+// expire and be revoked, the signature is what keeps the ID from being enough to use the token
+func newAPIToken(guildID string) (string, string, error) {
+	tokenID, err := randomString(8)
+	if err != nil {
+		return "", "", err
+	}
+	payload := guildID + "." + tokenID
+	return tokenID, payload + "." + signToken(payload), nil
+}
+
+// parseAPIToken returns the guild and ID of a token with a valid signature, false if it isn't one
+func parseAPIToken(token string) (string, string, bool) {
+	if config.APITokenSecret == "" {
+		return "", "", false
+	}
+
+	idx := strings.LastIndex(token, ".")
+	if idx < 0 {
+		return "", "", false
+	}
+	payload, signature := token[:idx], token[idx+1:]
+	if !hmac.Equal([]byte(signature), []byte(signToken(payload))) {
+		return "", "", false
+	}
+
+	guildID, tokenID, ok := strings.Cut(payload, ".")
+	return guildID, tokenID, ok && tokenID != ""
+}
+
+func signToken(payload string) string {
+	mac := hmac.New(sha256.New, []byte(config.APITokenSecret))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// authCookie builds the login cookies, the frontend lives on another origin so over https they have to be SameSite=None
+func authCookie(name string, value string, maxAge time.Duration) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if maxAge < 0 {
+		cookie.MaxAge = -1
+	}
+	if strings.HasPrefix(config.OAuthRedirectURL, "https://") {
+		cookie.Secure = true
+		cookie.SameSite = http.SameSiteNoneMode
+	}
+	return cookie
+}
@@ -1,29 +1,27 @@
 package bot
 
 import (
-	"archive/zip"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
-	"path/filepath"
-	"sort"
-	"strconv"
-	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
 	dca "github.com/cgoncalveslck/dcalck"
+	"github.com/cgoncalveslck/go-api-ebening/bot/metadata"
 )
 
-var Token string
-var store GlobalStore
+var store = newGlobalStore()
 
+// Command is a command's name in the commands channel, it's used with config.CommandPrefix in front
 type Command string
 
 // SoundList [SoundName]
@@ -35,26 +33,24 @@ type Entrances map[string]*Sound
 type Sound struct {
 	MessageID string `json:"messageId"`
 	URL       string `json:"url"`
-	Volume    int    `json:"volume"`
-	// dca uses 0-256 for some reason, try mapping it to 0-100 for better UX // change this to uint8
+	// Volume is in percent of the original file (0 mutes it), nil if it was never set (see Sound.volume)
+	Volume *int `json:"volume,omitempty"`
+	// Format is the file's extension (e.g. "ogg"), empty means mp3
+	Format string `json:"format,omitempty"`
+	// Size is the file's size in bytes and Hash its sha256, they're used to find duplicate uploads (see duplicates.go)
+	// either can be unknown (0/empty) for sounds loaded before they were tracked
+	Size int    `json:"size,omitempty"`
+	Hash string `json:"hash,omitempty"`
+	// Loudness is the file's integrated loudness in LUFS and Peak its true peak in dBTP (see audio.go),
+	// Loudness is 0 until the sound is measured
+	Loudness float64 `json:"loudness,omitempty"`
+	Peak     float64 `json:"peak,omitempty"`
 }
 
 type Channels struct {
 	VoiceChannels []VoiceChannel `json:"voiceChannels"`
 }
 
-type GuildState struct {
-	SoundList       SoundList  `json:"soundList"`
-	Entrances       Entrances  `json:"entrances"`
-	Channels        Channels   `json:"channels"`
-	SoundsChannelID string     `json:"soundsChannelID"`
-	Mutex           sync.Mutex `json:"-"`
-	StopPlayback    chan bool  `json:"-"`
-}
-
-// GlobalStore Store [guildID]
-type GlobalStore map[string]*GuildState
-
 type VoiceChannel struct {
 	ID             string
 	GuildID        string
@@ -63,75 +59,117 @@ type VoiceChannel struct {
 }
 
 const (
-	SoundsChannel   string = "sounds"
-	CommandsChannel string = "bot-commands"
+	PlaySound   Command = "s"
+	SkipSound   Command = "ss"
+	Connect     Command = "connect"
+	Help        Command = "help"
+	List        Command = "list"
+	Rename      Command = "rename"
+	AddEntrance Command = "addentrance"
+	Adjustvol   Command = "adjustvol"
+	Find        Command = "f"
+	Queue       Command = "queue"
+	Clear       Command = "clear"
+	Export      Command = "export"
+	Trim        Command = "trim"
+	Fade        Command = "fade"
+	// MasterVolume and MyVolume are guild settings, see settings.go
+	MasterVolume Command = "mastervolume"
+	MyVolume     Command = "myvolume"
 )
 
-const (
-	PlaySound   Command = ",s"
-	SkipSound   Command = ",ss"
-	Connect     Command = ",connect"
-	Help        Command = ",help"
-	List        Command = ",list"
-	Rename      Command = ",rename"
-	AddEntrance Command = ",addentrance"
-	Adjustvol   Command = ",adjustvol"
-	Find        Command = ",f"
-)
+// Run starts the bot and the HTTP server and blocks until either fails or the process gets SIGINT/SIGTERM
+func Run(cfg Config) error {
+	config = cfg
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	discord, err := discordgo.New("Bot " + config.Token)
+	if err != nil {
+		return fmt.Errorf("creating session: %w", err)
+	}
+
+	backend, err = openStore()
+	if err != nil {
+		return fmt.Errorf("opening store: %w", err)
+	}
+	defer backend.Close()
 
-func Run() {
-	discord, err := discordgo.New("Bot " + Token)
+	frames, err = openFrameCache(config.CacheDir, int64(config.CacheSizeMB)<<20)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("opening frame cache: %w", err)
 	}
 
-	discord.AddHandler(readyHandler)
-	discord.AddHandler(messageHandler)
-	discord.AddHandler(voiceStateUpdate)
+	discord.AddHandler(recovered("ready", readyHandler))
+	discord.AddHandler(recovered("message", messageHandler))
+	discord.AddHandler(recovered("voiceStateUpdate", voiceStateUpdate))
+	discord.AddHandler(recovered("interaction", interactionHandler))
+	discord.AddHandler(recovered("messageUpdate", messageUpdateHandler))
+	discord.AddHandler(recovered("messageDelete", messageDeleteHandler))
+	discord.AddHandler(recovered("messageDeleteBulk", messageDeleteBulkHandler))
+	discord.AddHandler(recovered("channelUpdate", channelUpdateHandler))
 
 	err = discord.Open()
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("opening session: %w", err)
 	}
 
 	// Expose store
-	http.HandleFunc("/", handleSoundList)
-	http.ListenAndServe(":8080", nil)
-
-	// keep bot running until there is NO os interruption (ctrl + C)
-	fmt.Println("Bot is running")
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	<-c
+	if config.APITokenSecret == "" && config.OAuthClientID == "" {
+		slog.Warn("neither OAuth2 login nor API tokens are configured, every guild request to the HTTP API will be rejected")
+	}
+	server := &http.Server{Addr: config.ListenAddr, Handler: withCors(newAPI(discord).routes())}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		if config.TLSCertFile != "" {
+			serverErr <- server.ListenAndServeTLS(config.TLSCertFile, config.TLSKeyFile)
+			return
+		}
+		serverErr <- server.ListenAndServe()
+	}()
+
+	// keep bot running until there is an os interruption (ctrl + C) or the server dies
+	slog.Info("bot is running", "addr", server.Addr)
+	select {
+	case <-ctx.Done():
+		slog.Info("shutting down")
+	case err = <-serverErr:
+		err = fmt.Errorf("http server: %w", err)
+	}
+
+	shutdown(discord, server)
+	return err
 }
 
-func enableCors(w *http.ResponseWriter) {
-	(*w).Header().Set("Access-Control-Allow-Origin", "https://gleaming-exploration-production.up.railway.app")
+// enableCors lets the request's origin read the response if it's one of config.AllowedOrigins
+func enableCors(w *http.ResponseWriter, r *http.Request) {
+	(*w).Header().Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	if origin == "" || !config.allowsOrigin(origin) {
+		return
+	}
+
+	// credentials (the session cookie) need the actual origin, "*" isn't allowed with them
+	(*w).Header().Set("Access-Control-Allow-Origin", origin)
 	(*w).Header().Set("Access-Control-Allow-Credentials", "true")
-	(*w).Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	(*w).Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
 	(*w).Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, Authorization")
 }
 
 func handleSoundList(w http.ResponseWriter, r *http.Request) {
-	enableCors(&w)
-
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusOK)
-		return
-	}
-
 	gID := r.URL.Query().Get("guildID")
-	gState, ok := store[gID]
+	gState, ok := store.Guild(gID)
 	if ok {
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(&gState)
+		json.NewEncoder(w).Encode(gState)
 		return
 	}
 	http.Error(w, "Guild not found", http.StatusNotFound)
 }
 
 // TODO:
-// 	look into error handling in general (remove panics and handle gracefully)
 // 	look into discord ui for messages (commands and message components)
 //  	https://discord.com/developers/docs/interactions/overview
 //  try improving zip upload
@@ -139,7 +177,6 @@ func handleSoundList(w http.ResponseWriter, r *http.Request) {
 //  maybe let commands be used in sounds channel but still delete them
 //  cleanup code repetition
 //  improve rate limit optimization (apply commands locally, queue api calls(???))
-// 	check if sound exists on upload
 // 	order .list
 //  profile mem with max load
 // 	entrances stack if user leaves/rejoins and bot is playing (shouldn't happen but for future reference)
@@ -151,71 +188,56 @@ func messageHandler(d *discordgo.Session, userMsg *discordgo.MessageCreate) {
 
 	channel, err := d.Channel(userMsg.ChannelID)
 	if err != nil {
-		log.Fatalf("Error getting channel: %v", err)
+		logError("getting channel", err, "guild", userMsg.GuildID, "channel", userMsg.ChannelID)
+		return
 	}
 
-	if channel.Name == CommandsChannel {
+	if channel.Name == config.CommandsChannel {
 		handleCommandsChannel(d, userMsg)
 	}
 
-	if channel.Name == SoundsChannel {
+	if channel.Name == config.SoundsChannel {
 		handleSoundsChannel(d, userMsg)
 	}
 
 }
 
 // PlayAudioFile modified sample from github.com/jonas747/dca
-func PlayAudioFile(d *discordgo.Session, guildID string, v *discordgo.VoiceConnection, sound *Sound) {
-	store[guildID].Mutex.Lock()
-	defer store[guildID].Mutex.Unlock()
-
-	select {
-	case <-store[guildID].StopPlayback:
-		fmt.Printf("Cleared existing stop signal for guild %s\n", guildID)
-	default:
-		fmt.Printf("No existing stop signal for guild %s\n", guildID)
+// it's only called from the guild's player (see queue.go), closing stop ends playback early
+// the guild's master volume and the volume of whoever requested it apply on top of the sound's own
+func PlayAudioFile(d *discordgo.Session, guildID string, v *discordgo.VoiceConnection, sound *Sound, requestedBy string, stop <-chan struct{}) error {
+	scale := 1.0
+	gState, ok := store.Guild(guildID)
+	if ok {
+		scale = gState.Settings().volumeScale(requestedBy)
 	}
+	filter := sound.volumeFilter(scale)
+	cacheName := frameCacheName(sound, filter)
 
-	opts := dca.StdEncodeOptions
-	opts.RawOutput = true
-	opts.Bitrate = 32
-	opts.CompressionLevel = 5
-
-	// use brain and redo this
-	if sound.Volume == 0 {
-		sound.Volume = 256
+	var source dca.OpusReader
+	ffmpegMessages := func() string { return "" }
+	if cached := frames.open(cacheName); cached != nil {
+		slog.Debug("playing cached frames", "guild", guildID, "message", sound.MessageID)
+		defer cached.Close()
+		source = dca.NewDecoder(cached)
 	} else {
-		opts.Volume = sound.Volume
+		slog.Debug("playing audio file", "guild", guildID, "message", sound.MessageID)
+		// the frames get cached as they play, the next play at this volume reads them from disk
+		encoding, err := startEncoding(d, gState, sound, filter, cacheName)
+		if err != nil {
+			return fmt.Errorf("encoding file: %w", err)
+		}
+		defer encoding.close()
+		source = encoding
+		ffmpegMessages = encoding.session.FFMPEGMessages
 	}
 
-	fmt.Println("Playing audio file")
-	// Decode the dca file
-	session, err := dca.EncodeFile(sound.URL, opts)
-	if err != nil {
-		fmt.Println("Error encoding file:", err)
-		return
+	if !waitVoiceReady(v, 10*time.Second) {
+		return errors.New("voice connection not ready")
 	}
-	defer session.Cleanup()
-	if v == nil || !v.Ready {
-		fmt.Println("Voice not ready")
-		v, err = d.ChannelVoiceJoin(guildID, store[guildID].SoundsChannelID, false, true)
-		if err != nil {
-			fmt.Println("Error joining voice channel:", err)
-			return
-		}
-		for {
-			fmt.Println("Waiting for voice to be ready")
-			if v.Ready {
-				fmt.Println("Voice ready")
-				break
-			}
-			time.Sleep(50 * time.Millisecond)
-		}
-		err = v.Speaking(true)
-		if err != nil {
-			fmt.Println("Error setting speaking:", err)
-			return
-		}
+	err := v.Speaking(true)
+	if err != nil {
+		return fmt.Errorf("setting speaking: %w", err)
 	}
 
 	ticker := time.NewTicker(20 * time.Millisecond)
@@ -223,24 +245,20 @@ func PlayAudioFile(d *discordgo.Session, guildID string, v *discordgo.VoiceConne
 
 	for {
 		select {
-		case <-store[guildID].StopPlayback:
+		case <-stop:
 			time.Sleep(100 * time.Millisecond)
-			return
+			return nil
 		case <-ticker.C:
-			frame, err := session.OpusFrame()
-
+			frame, err := source.OpusFrame()
+			if err == io.EOF {
+				return nil
+			}
 			if err != nil {
-				fmt.Println("Error:", err)
-				fmt.Println(session.FFMPEGMessages())
-				if err != io.EOF {
-					panic("Failed retrieving opus frame")
-				}
-				return
+				return fmt.Errorf("retrieving opus frame: %w (ffmpeg: %s)", err, ffmpegMessages())
 			}
 
 			if frame == nil {
-				fmt.Println("Frame is nil")
-				return
+				return errors.New("retrieving opus frame: empty frame")
 			}
 
 			v.OpusSend <- frame
@@ -248,414 +266,51 @@ func PlayAudioFile(d *discordgo.Session, guildID string, v *discordgo.VoiceConne
 	}
 }
 
-func handleCommandsChannel(d *discordgo.Session, uMsg *discordgo.MessageCreate) {
-	if len(uMsg.Attachments) > 0 {
-		return
-	}
-
-	command := strings.Split(uMsg.Content, " ")[0]
-	switch {
-	case command == string(SkipSound):
-		handleSkipSound(d, uMsg)
-	case command == string(Help):
-		formattedMessage :=
-			"### To add sounds, just send them to the 'sounds' channel as a message (just the file, no text)\n" +
-				"**Commands:**\n" +
-				"`,s <sound-name>` Plays a sound\n" +
-				"`,connect` Connects to the voice channel you are in.\n" +
-				"`,list` Lists all sounds in the sounds channel.\n" +
-				"`,ss` Stops the current sound.\n" +
-				"`,ss <sound-name>` Skips current sound and plays new one.\n" +
-				"`,rename <current-name> <new-name>` Renames a sound.\n" +
-				"`,addentrance <sound-name>` Sets a sound as your entrance sound.\n" +
-				"`,adjustvol <sound-name> <volume>` Adjusts the volume of a sound (0-512).\n" +
-				"`,f <sound-name>` Finds a sound by name and returns a link to it."
-
-		_, err := d.ChannelMessageSend(uMsg.Message.ChannelID, formattedMessage)
-		checkError(err)
-
-	case command == string(Connect):
-		voiceState, err := d.State.VoiceState(uMsg.Message.GuildID, uMsg.Author.ID)
-		if err != nil {
-			_, err := d.ChannelMessageSend(uMsg.Message.ChannelID, "Error getting voice state")
-			checkError(err)
-			return
-		}
-
-		v, err := d.ChannelVoiceJoin(uMsg.Message.GuildID, voiceState.ChannelID, false, false)
-		if err != nil {
-			panic(err)
-		}
-
-		if v == nil {
-			_, err := d.ChannelMessageSendReply(uMsg.Message.ChannelID, "You need to be in a voice channel", uMsg.Reference())
-			checkError(err)
-			return
-		}
-
-	case command == string(Rename):
-		sList := store[uMsg.Message.GuildID].SoundList
-		// find file by name, upload it with new name, delete old file
-		searchTerm := strings.Split(uMsg.Content, " ")[1]
-		newName := strings.Split(uMsg.Content, " ")[2]
-		sound, ok := sList[searchTerm]
-		if !ok {
-			_, err := d.ChannelMessageSend(uMsg.Message.ChannelID, "Sound not found")
-			checkError(err)
-			return
-		}
-
-		updatedMessage, updatedSound, err := reuploadSound(d, uMsg, sound, searchTerm, newName)
-		if updatedMessage == nil || updatedSound == nil || err != nil {
-			_, err := d.ChannelMessageSend(uMsg.Message.ChannelID, "Error re-uploading sound")
-			if err != nil {
-				panic(err)
-			}
-			return
-		}
-
-		// this is ugly af, check if there's a better way to do this
-		sound.MessageID = updatedMessage.ID
-		sList[newName] = updatedSound
-		delete(sList, searchTerm)
-
-		_, err = d.ChannelMessageSendReply(uMsg.Message.ChannelID, "Sound renamed", uMsg.Reference())
-		checkError(err)
-
-	case command == string(AddEntrance):
-		sList := store[uMsg.Message.GuildID].SoundList
-		searchTerm := strings.Split(uMsg.Content, " ")[1]
-
-		sound, ok := sList[searchTerm]
-		if !ok {
-			_, err := d.ChannelMessageSend(uMsg.Message.ChannelID, "Sound not found")
-			checkError(err)
-			return
-		}
-
-		soundMessage, err := d.ChannelMessage(store[uMsg.GuildID].SoundsChannelID, sound.MessageID)
-		if err != nil {
-			_, err := d.ChannelMessageSend(uMsg.Message.ChannelID, "Error getting sound message")
-			if err != nil {
-				panic(err)
-			}
-			return
-		}
-
-		if !soundMessage.Author.Bot {
-			updatedMessage, updatedSound, err := reuploadSound(d, uMsg, sound, searchTerm, "")
-			if updatedMessage == nil || updatedSound == nil || err != nil {
-				_, err := d.ChannelMessageSend(uMsg.Message.ChannelID, "Error re-uploading sound")
-				if err != nil {
-					panic(err)
-				}
-				return
-			}
-			soundMessage = updatedMessage
-			// updatedMessage here sometimes doesn't have GuildID??? idk why
-			store[uMsg.Message.GuildID].SoundList[searchTerm] = updatedSound
-			sound = updatedSound
-		}
-
-		userEntrance, ok := store[uMsg.Message.GuildID].Entrances[uMsg.Author.ID]
-		if ok {
-			if userEntrance.MessageID == sound.MessageID {
-				_, err := d.ChannelMessageSend(uMsg.Message.ChannelID, "This is already your entrance")
-				checkError(err)
-				return
-			} else {
-				delete(store[uMsg.Message.GuildID].Entrances, uMsg.Author.ID)
-				oldEntranceMessage, err := d.ChannelMessage(store[uMsg.GuildID].SoundsChannelID, userEntrance.MessageID)
-				if err != nil {
-					if strings.Contains(err.Error(), "HTTP 404") {
-						delete(store[uMsg.Message.GuildID].Entrances, uMsg.Author.ID)
-					} else {
-						panic(err)
-					}
-				}
-
-				// remove volume from message
-				if oldEntranceMessage != nil && oldEntranceMessage.Content != "" {
-					updatedTags := ""
-					messageTags := strings.Split(oldEntranceMessage.Content, ";")
-					for _, tag := range messageTags {
-						if tag == "" {
-							continue
-						}
-
-						typeValue := strings.Split(tag, ":")
-						tagType := typeValue[0]
-
-						if tagType == "e" {
-							continue
-						} else {
-							updatedTags += tag + ";"
-						}
-					}
-
-					oldEntranceMessage.Content = updatedTags
-					_, err = d.ChannelMessageEdit(store[uMsg.Message.GuildID].SoundsChannelID, oldEntranceMessage.ID, oldEntranceMessage.Content)
-					if err != nil {
-						_, err := d.ChannelMessageSend(uMsg.Message.ChannelID, "Error removing volume from old entrance")
-						if err != nil {
-							panic(err)
-						}
-						return
-					}
-				}
-			}
-		}
-
-		// right now a message tag can look like "e:userID;v:0-100;e:userID;"
-		// where e: says that sound is an entrance to that user and v: is the volume for that sound
-		messageTags := strings.Split(soundMessage.Content, ";")
-		if len(messageTags) > 0 {
-			for _, tag := range messageTags {
-				if tag == "" {
-					continue
-				}
-				typeValue := strings.Split(tag, ":")
-				tagType, tagValue := typeValue[0], typeValue[1]
-
-				if tagType == "e" {
-					if tagValue == uMsg.Author.ID {
-						_, err := d.ChannelMessageSend(uMsg.Message.ChannelID, "This is already your entrance")
-						checkError(err)
-						return
-					}
-				}
-			}
-
-		}
-
-		soundMessage.Content += "e:" + uMsg.Author.ID + ";"
-		_, err = d.ChannelMessageEdit(store[uMsg.Message.GuildID].SoundsChannelID, soundMessage.ID, soundMessage.Content)
-		checkError(err)
-
-		store[uMsg.Message.GuildID].Entrances[uMsg.Author.ID] = sound
-		_, err = d.ChannelMessageSendReply(uMsg.Message.ChannelID, "Entrance set", uMsg.Reference())
-		checkError(err)
-
-	case command == string(Adjustvol):
-		searchTerm := strings.Split(uMsg.Content, " ")[1]
-		volStr := strings.Split(uMsg.Content, " ")[2]
-		volInt, err := strconv.ParseInt(volStr, 10, 64)
-		if err != nil {
-			_, err := d.ChannelMessageSend(uMsg.Message.ChannelID, "Volume must be between 1 and 512 (0-200%)")
-			if err != nil {
-				panic(err)
-			}
-		}
-
-		if volInt < 0 || volInt > 512 {
-			_, err := d.ChannelMessageSend(uMsg.Message.ChannelID, "Volume must be between 1 and 512 (0-200%)")
-			checkError(err)
-			return
-		}
-
-		sound, ok := store[uMsg.Message.GuildID].SoundList[searchTerm]
-		if !ok {
-			_, err := d.ChannelMessageSend(uMsg.Message.ChannelID, "Sound not found")
-			checkError(err)
-			return
-		}
-
-		soundMessage, err := d.ChannelMessage(store[uMsg.Message.GuildID].SoundsChannelID, sound.MessageID)
-		if err != nil {
-			panic(err)
-		}
-
-		// make function for this
-		if !soundMessage.Author.Bot {
-			updatedMessage, updatedSound, err := reuploadSound(d, uMsg, sound, searchTerm, "")
-			if updatedMessage == nil || updatedSound == nil || err != nil {
-				_, err := d.ChannelMessageSend(uMsg.Message.ChannelID, "Error re-uploading sound")
-				if err != nil {
-					panic(err)
-				}
-				return
-			}
-			soundMessage = updatedMessage
-			store[uMsg.Message.GuildID].SoundList[searchTerm] = updatedSound
-			sound = updatedSound
-		}
-
-		updatedTags := ""
-		if soundMessage.Content != "" {
-			messageTags := strings.Split(soundMessage.Content, ";")
-			for _, tag := range messageTags {
-				if tag == "" {
-					continue
-				}
-
-				typeValue := strings.Split(tag, ":")
-				tagType := typeValue[0]
-
-				if tagType == "v" {
-					continue
-				} else {
-					updatedTags += tag + ";"
-				}
-			}
-		}
-
-		updatedTags += "v:" + volStr + ";"
-		soundMessage.Content = updatedTags
-		_, err = d.ChannelMessageEdit(store[uMsg.Message.GuildID].SoundsChannelID, soundMessage.ID, soundMessage.Content)
-		if err != nil {
-			panic(err)
-		}
-		store[uMsg.Message.GuildID].SoundList[searchTerm].Volume = int(volInt)
-		_, err = d.ChannelMessageSendReply(uMsg.Message.ChannelID, "Volume adjusted", uMsg.Reference())
-		checkError(err)
-	case command == string(Find):
-		searchTerm := strings.Split(uMsg.Content, " ")[1]
-		sound, ok := store[uMsg.Message.GuildID].SoundList[searchTerm]
-		if !ok {
-			_, err := d.ChannelMessageSend(uMsg.Message.ChannelID, "Sound not found")
-			checkError(err)
-			return
-		}
-
-		messageLink := "https://discordapp.com/channels/" + uMsg.Message.GuildID + "/" + store[uMsg.Message.GuildID].SoundsChannelID + "/" + sound.MessageID
-		messageMarkdown := "Found this: [" + searchTerm + "](" + messageLink + ")"
-		_, err := d.ChannelMessageSendReply(uMsg.Message.ChannelID, messageMarkdown, uMsg.Reference())
-		checkError(err)
-	case command == string(PlaySound):
-		if len(store[uMsg.Message.GuildID].SoundList) == 0 {
-			_, err := d.ChannelMessageSend(uMsg.Message.ChannelID, "No sounds loaded")
-			checkError(err)
-			return
-		}
-
-		voiceState, err := d.State.VoiceState(uMsg.Message.GuildID, uMsg.Author.ID)
-		if err != nil {
-			_, err := d.ChannelMessageSend(uMsg.Message.ChannelID, "Error getting voice state")
-			checkError(err)
-			return
-		}
-
-		channelID := voiceState.ChannelID
-		voice, err := d.ChannelVoiceJoin(uMsg.Message.GuildID, channelID, false, false)
-		if err != nil {
-			panic(err)
-		}
-
-		if voice == nil {
-			fmt.Println("Voice is nil outside")
-			_, err := d.ChannelMessageSendReply(uMsg.Message.ChannelID, "You need to be in a voice channel", uMsg.Reference())
-			checkError(err)
-			return
-		}
-
-		//lookup sound locally only, upload or boot should assure it's either here or nowhere
-		mSplit := strings.Split(uMsg.Content, " ")
-
-		if len(mSplit) != 2 {
-			fmt.Println("Invalid command")
-			// TODO: handle this properly and call .help
-			return
-		}
-
-		searchTerm := mSplit[1]
-		sound, ok := store[uMsg.Message.GuildID].SoundList[searchTerm]
-		if !ok {
-			fmt.Println("Sound not found")
-			_, err := d.ChannelMessageSend(uMsg.Message.ChannelID, "Sound not found")
-			checkError(err)
-			return
-		}
-
-		go PlayAudioFile(d, uMsg.GuildID, voice, sound)
-
-	case command == string(List):
-		// shoutout rasmussy
-		sList := store[uMsg.Message.GuildID].SoundList
-		soundNames := make([]string, 0, len(sList))
-		for name := range sList {
-			soundNames = append(soundNames, name)
-		}
-		sort.Strings(soundNames)
-
-		listOutput := "```(" + fmt.Sprint(len(sList)) + ") " + "Available sounds :\n------------------\n\n"
-		nb := 0
-		for _, name := range soundNames {
-			nb += 1
-			var soundName = name
-			for len(soundName) < 15 {
-				soundName += " "
-			}
-			listOutput += soundName + "\t"
-			if nb%6 == 0 {
-				listOutput += "\n"
-			}
-			// Discord max message length is 2000
-			if len(listOutput) > 1950 { // removed condition for max sounds printed
-				listOutput += "```"
-				_, err := d.ChannelMessageSend(uMsg.Message.ChannelID, listOutput)
-				checkError(err)
-				listOutput = "```"
-			}
-		}
-		listOutput += "```"
-		if listOutput != "``````" {
-			_, err := d.ChannelMessageSend(uMsg.Message.ChannelID, listOutput)
-			checkError(err)
-		}
-	}
-}
-
 // discord rate limit's at around 4/5 quick requests and this does 1 per 100 sounds (4 at the current 390 sounds)
-// loads sounds and entrances to memory
-func getSoundsRecursive(d *discordgo.Session, guildID string, beforeID string) error {
-	fmt.Println("Getting sounds")
-	soundsChannelID, err := getSoundsChannelID(d, guildID)
-	checkError(err)
+// loads sounds and entrances to memory, the bot's messages with metadata in an old format are added to migrations
+func getSoundsRecursive(d *discordgo.Session, soundsChannelID string, beforeID string, sList SoundList, entrances Entrances, migrations map[string]metadata.Metadata) error {
+	slog.Debug("getting sounds", "channel", soundsChannelID, "before", beforeID)
 	channelMessages, err := d.ChannelMessages(soundsChannelID, 100, beforeID, "", "")
 	if err != nil {
 		return err
 	}
 
 	for _, channelMessage := range channelMessages {
-		if len(channelMessage.Attachments) > 0 {
-			fileName := channelMessage.Attachments[0].Filename
-			if strings.Split(fileName, ".")[1] != "mp3" {
+		// the bot's messages have one file and its metadata, an upload of several files has no metadata
+		var meta metadata.Metadata
+		if len(channelMessage.Attachments) == 1 {
+			meta, err = metadata.Decode(channelMessage.Content)
+			if err != nil {
+				// the sound still plays, its message is left alone so nothing in it gets overwritten
+				slog.Warn("ignoring sound metadata", "message", channelMessage.ID, "err", err)
+			}
+		}
+
+		for _, attachment := range channelMessage.Attachments {
+			trimmedName, format, ok := storedSoundFile(attachment.Filename)
+			if !ok {
 				continue
 			}
-			trimmedName := strings.TrimSuffix(fileName, ".mp3")
 
 			sound := &Sound{
 				MessageID: channelMessage.ID,
-				URL:       channelMessage.Attachments[0].URL,
+				URL:       attachment.URL,
+				Volume:    meta.Volume,
+				Format:    format,
+				Size:      attachment.Size,
+				Loudness:  meta.Loudness,
+				Peak:      meta.Peak,
 			}
 
-			if channelMessage.Content != "" {
-				messageTags := strings.Split(channelMessage.Content, ";")
-
-				for _, tag := range messageTags {
-					if tag == "" {
-						continue
-					}
-
-					tag := strings.Split(tag, ":")
-					tagType, tagValue := tag[0], tag[1]
-
-					if tagType == "e" {
-						// tagValue is the user ID
-						store[guildID].Entrances[tagValue] = sound
-					}
+			for _, userID := range meta.Entrances {
+				entrances[userID] = sound
+			}
+			sList[trimmedName] = sound
 
-					if tagType == "v" {
-						// tagValue is the volume
-						volInt, err := strconv.ParseInt(tagValue, 10, 64)
-						if err != nil {
-							panic(err)
-						}
-						sound.Volume = int(volInt)
-					}
-				}
+			// only messages the bot sent can be edited, user uploads get migrated when they're re-uploaded
+			if meta.NeedsMigration() && channelMessage.Author.ID == d.State.User.ID {
+				migrations[channelMessage.ID] = meta
 			}
-			store[guildID].SoundList[trimmedName] = sound
 		}
 	}
 
@@ -665,7 +320,7 @@ func getSoundsRecursive(d *discordgo.Session, guildID string, beforeID string) e
 	}
 
 	lastMessageID := channelMessages[len(channelMessages)-1].ID
-	return getSoundsRecursive(d, guildID, lastMessageID)
+	return getSoundsRecursive(d, soundsChannelID, lastMessageID, sList, entrances, migrations)
 }
 
 func getSoundsChannelID(d *discordgo.Session, guildID string) (string, error) {
@@ -675,100 +330,85 @@ func getSoundsChannelID(d *discordgo.Session, guildID string) (string, error) {
 	}
 
 	for _, channel := range channels {
-		if channel.Name == SoundsChannel {
+		if channel.Name == config.SoundsChannel {
 			return channel.ID, nil
 		}
 	}
 
-	return "", errors.New("no 'sounds' channel found")
+	return "", errNoSoundsChannel
 }
 
 func readyHandler(d *discordgo.Session, ready *discordgo.Ready) {
-	fmt.Println("Bot is ready")
+	slog.Info("bot is ready", "guilds", len(ready.Guilds))
 
 	buildStore(d, ready)
-	fmt.Println("Store initialized")
+	slog.Info("store initialized")
 
-	go maintainStore(d, ready)
-}
-
-func handleSkipSound(d *discordgo.Session, uMsg *discordgo.MessageCreate) {
-	if store[uMsg.GuildID].StopPlayback != nil {
-		select {
-		case store[uMsg.GuildID].StopPlayback <- true:
-			fmt.Println("Stopping playback")
-		default:
-			fmt.Println("Channel is full or closed")
-		}
-	}
-
-	time.Sleep(500 * time.Millisecond)
-	if len(strings.Split(uMsg.Content, " ")) > 1 {
-		searchTerm := strings.Split(uMsg.Content, " ")[1]
-		sound, ok := store[uMsg.Message.GuildID].SoundList[searchTerm]
-		if !ok {
-			_, err := d.ChannelMessageSend(uMsg.Message.ChannelID, "Sound not found")
-			checkError(err)
-			return
-		}
-
-		voiceState, err := d.State.VoiceState(uMsg.Message.GuildID, uMsg.Author.ID)
+	for _, guild := range ready.Guilds {
+		err := registerSlashCommands(d, guild.ID)
 		if err != nil {
-			_, err := d.ChannelMessageSend(uMsg.Message.ChannelID, "Error getting voice state")
-			checkError(err)
-			return
+			logError("registering slash commands", err, "guild", guild.ID)
 		}
-
-		voice, _ := d.ChannelVoiceJoin(uMsg.Message.GuildID, voiceState.ChannelID, false, false)
-		go PlayAudioFile(d, uMsg.GuildID, voice, sound)
 	}
 
+	// ready fires again on reconnects, only one reconciliation loop should run
+	maintainOnce.Do(func() {
+		go maintainStore(d)
+	})
 }
 
-func maintainStore(d *discordgo.Session, ready *discordgo.Ready) {
-	rebuildTicker := time.NewTicker(4 * time.Hour)
-	for range rebuildTicker.C {
-		buildStore(d, ready)
-	}
-}
-
+// buildStore loads every guild into a new GlobalStore and only swaps it in when it's complete
 func buildStore(d *discordgo.Session, ready *discordgo.Ready) {
-	store = make(GlobalStore)
+	built := make(map[string]*GuildState)
 
 	for _, guild := range ready.Guilds {
+		// keep the queue (and its player) across rebuilds, a new guild's player only starts once the guild is in the store
+		old, rebuilding := store.Guild(guild.ID)
+		queue := newPlaybackQueue(guild.ID)
+		if rebuilding {
+			queue = old.Queue
+		}
+		add := func(gState *GuildState) {
+			built[guild.ID] = gState
+			if !rebuilding {
+				go queue.run(d)
+			}
+		}
+
+		// a guild without a sounds channel still gets a (soundless) state, channelUpdateHandler picks the channel up once it exists
 		soundsChannelID, err := getSoundsChannelID(d, guild.ID)
 		if err != nil {
-			panic(err)
+			logError("getting sounds channel", err, "guild", guild.ID)
+			add(newGuildState(guild.ID, "", make(SoundList), make(Entrances), GuildSettings{}, queue))
+			continue
 		}
 
-		store[guild.ID] = &GuildState{
-			SoundList:       make(SoundList),
-			Entrances:       make(Entrances),
-			SoundsChannelID: soundsChannelID,
-			Channels: Channels{
-				VoiceChannels: []VoiceChannel{},
-			},
-			StopPlayback: make(chan bool, 1),
+		sList, entrances, err := backend.Load(d, guild.ID, soundsChannelID)
+		if err != nil {
+			logError("loading sounds", err, "guild", guild.ID)
+			if rebuilding {
+				built[guild.ID] = old
+			}
+			continue
 		}
-	}
 
-	for guildID := range store {
-		err := getSoundsRecursive(d, guildID, "")
-		checkError(err)
-	}
-}
+		// sounds still play without the guild's settings, just at the default volumes
+		settings, err := backend.LoadSettings(d, guild.ID, soundsChannelID)
+		if err != nil {
+			logError("loading settings", err, "guild", guild.ID)
+		}
 
-// this is temporary, I'll make it work first then clean all this up
-func checkError(err error) {
-	if err != nil {
-		panic(err)
+		add(newGuildState(guild.ID, soundsChannelID, sList, entrances, settings, queue))
 	}
+
+	store.Replace(built)
 }
 
 func getUsersInVC(d *discordgo.Session, guildID string) {
 	currentGuild, err := d.State.Guild(guildID)
 	if err != nil {
-		panic(err)
+		logError("getting guild from state", err, "guild", guildID)
+		return
 	}
 
 	voiceChannelsMap := make(map[string]*VoiceChannel)
@@ -787,7 +427,7 @@ func getUsersInVC(d *discordgo.Session, guildID string) {
 		if vc, ok := voiceChannelsMap[vs.ChannelID]; ok {
 			user, err := d.User(vs.UserID)
 			if err != nil {
-				fmt.Println("Error getting user:", err)
+				logError("getting user", err, "guild", guildID, "user", vs.UserID)
 				continue
 			}
 			if !user.Bot {
@@ -796,117 +436,114 @@ func getUsersInVC(d *discordgo.Session, guildID string) {
 		}
 	}
 
-	var Channels Channels
+	voiceChannels := []VoiceChannel{}
 	for _, vc := range voiceChannelsMap {
-		Channels.VoiceChannels = append(Channels.VoiceChannels, *vc)
+		voiceChannels = append(voiceChannels, *vc)
 	}
 
-	// check if I actually have to do this
-	guildState := store[guildID]
-	guildState.Channels = Channels
-	store[guildID] = guildState
+	gState, ok := store.Guild(guildID)
+	if ok {
+		gState.SetVoiceChannels(voiceChannels)
+	}
 }
 
 func voiceStateUpdate(d *discordgo.Session, v *discordgo.VoiceStateUpdate) {
+	gState, ok := store.Guild(v.GuildID)
+	if !ok {
+		return
+	}
+
 	if v.Member.User.Bot {
 		if v.BeforeUpdate != nil && v.BeforeUpdate.ChannelID != "" {
-			voiceChannelStateUpdate(d, v)
+			voiceChannelStateUpdate(d, gState, v)
 		}
 		return
 	}
 
-	if len(store[v.GuildID].Channels.VoiceChannels) == 0 {
+	if len(gState.VoiceChannels()) == 0 {
 		getUsersInVC(d, v.GuildID)
 	}
 
-	voiceChannelStateUpdate(d, v)
+	voiceChannelStateUpdate(d, gState, v)
 	// plays entrance if user joins a voice channel, doesn't on switch
 	if v.ChannelID != "" && v.BeforeUpdate == nil {
-		userEntrance, ok := store[v.GuildID].Entrances[v.UserID]
+		userEntrance, ok := gState.Entrance(v.UserID)
 		if ok {
-			voice, err := d.ChannelVoiceJoin(v.GuildID, v.ChannelID, false, false)
-			if err != nil {
-				panic(err)
-			}
-
-			if voice == nil {
-				return
-			}
-
+			name, _ := gState.SoundName(userEntrance)
 			// wait a sec for discord channel join sound etc
 			time.Sleep(1 * time.Second)
-			go PlayAudioFile(d, v.GuildID, voice, userEntrance)
+			gState.Queue.Enqueue(&QueueItem{
+				Name:        name,
+				Sound:       userEntrance,
+				ChannelID:   v.ChannelID,
+				RequestedBy: v.UserID,
+			})
 		}
 	}
 }
 
-func voiceChannelStateUpdate(d *discordgo.Session, v *discordgo.VoiceStateUpdate) {
-	guildID := v.GuildID
-	userID := v.UserID
-
-	// Remove user from their previous channel (if any)
-	for idx, vc := range store[guildID].Channels.VoiceChannels {
-		for i, user := range vc.UsersConnected {
-			if user.ID == userID {
-				store[guildID].Channels.VoiceChannels[idx].UsersConnected = append(vc.UsersConnected[:i], vc.UsersConnected[i+1:]...)
-				break
-			}
-		}
+func voiceChannelStateUpdate(d *discordgo.Session, gState *GuildState, v *discordgo.VoiceStateUpdate) {
+	if v.ChannelID == "" {
+		gState.MoveUser(v.UserID, "", nil)
+		return
 	}
 
-	// Add user to their new channel (if they joined one)
-	if v.ChannelID != "" {
-		for idx, vc := range store[guildID].Channels.VoiceChannels {
-			if vc.ID == v.ChannelID {
-				user, err := d.User(userID)
-				if err != nil {
-					fmt.Println("Error getting user:", err)
-					return
-				}
-				store[guildID].Channels.VoiceChannels[idx].UsersConnected = append(vc.UsersConnected, *user)
-				return
-			}
-		}
+	user, err := d.User(v.UserID)
+	if err != nil {
+		logError("getting user", err, "guild", v.GuildID, "user", v.UserID)
+		gState.MoveUser(v.UserID, "", nil)
+		return
 	}
+	gState.MoveUser(v.UserID, v.ChannelID, user)
 }
 
-func reuploadSound(d *discordgo.Session, uMsg *discordgo.MessageCreate, sound *Sound, searchTerm string, fileName string) (*discordgo.Message, *Sound, error) {
-	req, err := http.Get(sound.URL)
+// reuploadSound posts the sound's file again as the bot (named fileName, or searchTerm) and deletes the old message (see uploadSoundFile)
+func reuploadSound(d *discordgo.Session, guildID string, sound *Sound, searchTerm string, fileName string) (*discordgo.Message, *Sound, error) {
+	gState, _ := store.Guild(guildID)
+	resp, err := downloadSound(context.Background(), d, gState, sound)
 	if err != nil {
 		return nil, nil, err
 	}
-	defer req.Body.Close()
+	defer resp.Body.Close()
+
+	return uploadSoundFile(d, guildID, sound, searchTerm, fileName, resp.Body)
+}
 
-	oldMessage, err := d.ChannelMessage(store[uMsg.Message.GuildID].SoundsChannelID, sound.MessageID)
+// uploadSoundFile posts file as the sound's new message (with its metadata) and deletes the old one, unless the old
+// one has other files (an upload of several sounds), those are still sounds.
+// sound describes the new file, its MessageID is still the old message
+func uploadSoundFile(d *discordgo.Session, guildID string, sound *Sound, searchTerm string, fileName string, file io.Reader) (*discordgo.Message, *Sound, error) {
+	gState, err := loadedGuild(guildID)
 	if err != nil {
 		return nil, nil, err
 	}
+	soundsChannelID := gState.SoundsChannelID()
 
-	if strings.Contains(oldMessage.Content, "e:") {
-		for _, tag := range strings.Split(oldMessage.Content, ";") {
-			if tag == "" {
-				continue
-			}
-
-			typeValue := strings.Split(tag, ":")
-			tagType, tagValue := typeValue[0], typeValue[1]
+	oldMessage, err := d.ChannelMessage(soundsChannelID, sound.MessageID)
+	if err != nil {
+		return nil, nil, err
+	}
 
-			if tagType == "e" {
-				store[uMsg.Message.GuildID].Entrances[tagValue] = sound
-			}
-		}
+	meta, err := metadata.Decode(oldMessage.Content)
+	if err != nil {
+		return nil, nil, err
+	}
+	// user uploads only have their loudness in memory, the bot's message can keep it
+	if sound.Loudness != 0 {
+		meta.Loudness = sound.Loudness
+		meta.Peak = sound.Peak
 	}
 
 	if fileName == "" {
 		fileName = searchTerm
 	}
 
-	soundMessage, err := d.ChannelMessageSendComplex(store[uMsg.Message.GuildID].SoundsChannelID, &discordgo.MessageSend{
-		Content: oldMessage.Content,
+	soundMessage, err := d.ChannelMessageSendComplex(soundsChannelID, &discordgo.MessageSend{
+		Content: meta.Encode(),
 		Files: []*discordgo.File{
 			{
-				Name:   fileName + ".mp3",
-				Reader: req.Body,
+				Name:   sound.fileName(fileName),
+				Reader: file,
 			},
 		},
 	})
@@ -914,127 +551,102 @@ func reuploadSound(d *discordgo.Session, uMsg *discordgo.MessageCreate, sound *S
 		return nil, nil, err
 	}
 
-	err = d.ChannelMessageDelete(store[uMsg.Message.GuildID].SoundsChannelID, sound.MessageID)
-	if err != nil {
-		return nil, nil, err
+	if len(oldMessage.Attachments) <= 1 {
+		expectDelete(sound.MessageID)
+		err = d.ChannelMessageDelete(soundsChannelID, sound.MessageID)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
+	forgetSoundFile(sound)
 
 	updatedSound := &Sound{
 		MessageID: soundMessage.ID,
 		URL:       soundMessage.Attachments[0].URL,
 		Volume:    sound.Volume,
+		Format:    sound.Format,
+		Size:      sound.Size,
+		Hash:      sound.Hash,
+		Loudness:  sound.Loudness,
+		Peak:      sound.Peak,
 	}
 
 	return soundMessage, updatedSound, nil
 }
 
-func downloadFile(filepath string, url string) (err error) {
-	out, err := os.Create("sounds/" + filepath)
-	if err != nil {
-		return err
-	}
-	defer out.Close()
+// migratedMessages [MessageID] are messages migrateMetadata already took, every load finds the ones it
+// hasn't gotten to yet again and each message is only tried once
+var migratedMessages sync.Map
 
-	resp, err := http.Get(url)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
+// migrateMetadata rewrites sound messages' old style tags in the current metadata format, one message at a time
+func migrateMetadata(d *discordgo.Session, channelID string, migrations map[string]metadata.Metadata) {
+	for messageID, meta := range migrations {
+		if _, taken := migratedMessages.LoadOrStore(messageID, struct{}{}); taken {
+			continue
+		}
 
-	_, err = io.Copy(out, resp.Body)
-	if err != nil {
-		return err
+		_, err := d.ChannelMessageEdit(channelID, messageID, meta.Encode())
+		if err != nil {
+			logError("migrating metadata", err, "channel", channelID, "message", messageID)
+			continue
+		}
+		slog.Info("migrated metadata", "message", messageID, "from", meta.Version, "to", metadata.Version)
 	}
-
-	return nil
 }
 
 func handleSoundsChannel(d *discordgo.Session, uMsg *discordgo.MessageCreate) {
+	gState, ok := store.Guild(uMsg.GuildID)
+	if !ok {
+		return
+	}
+
 	if len(uMsg.Attachments) > 0 {
 		for _, attachment := range uMsg.Attachments {
-			if strings.Split(attachment.Filename, ".")[1] == "zip" {
-				handleZipUpload(d, uMsg, attachment)
+			if isZip(attachment.Filename) {
+				err := handleZipUpload(d, uMsg, attachment)
+				if err != nil {
+					if !expectedError(err) {
+						logError("importing zip", err, "guild", uMsg.GuildID, "file", attachment.Filename)
+					}
+					_, err = d.ChannelMessageSendReply(uMsg.ChannelID, "Error importing "+attachment.Filename+": "+userMessage(err), uMsg.Reference())
+					if err != nil {
+						logError("sending error reply", err, "guild", uMsg.GuildID)
+					}
+				}
+				continue
 			}
 
-			if strings.Split(attachment.Filename, ".")[1] == "mp3" {
-				store[uMsg.Message.GuildID].SoundList[strings.TrimSuffix(attachment.Filename, ".mp3")] = &Sound{
-					MessageID: uMsg.ID,
-					URL:       attachment.URL,
+			name, format, ok := soundFile(attachment.Filename)
+			if !ok {
+				_, err := d.ChannelMessageSendReply(uMsg.ChannelID, unsupportedFormatMessage(attachment.Filename), uMsg.Reference())
+				if err != nil {
+					logError("sending unsupported format reply", err, "guild", uMsg.GuildID)
 				}
+				continue
 			}
+
+			sound := &Sound{
+				MessageID: uMsg.ID,
+				URL:       attachment.URL,
+				Format:    format,
+				Size:      attachment.Size,
+			}
+			handleUpload(d, uMsg, gState, attachment, name, sound)
 		}
 	} else {
 		warningMsg, err := d.ChannelMessageSendReply(uMsg.Message.ChannelID, "Please use this channel for files only", uMsg.Reference())
 		if err != nil {
-			log.Fatalf("Error sending message: %v", err)
+			logError("sending files only warning", err, "guild", uMsg.GuildID)
+			return
 		}
 		time.Sleep(3 * time.Second)
 		err = d.ChannelMessageDelete(uMsg.Message.ChannelID, uMsg.ID)
-		checkError(err)
-		err = d.ChannelMessageDelete(uMsg.Message.ChannelID, warningMsg.ID)
-		checkError(err)
-	}
-}
-
-// // This is most likely not the best way to do this
-// // if message has a zip file, extract it and send every .mp3 file to the sounds channel
-// // delete the original message and the files written to disk
-func handleZipUpload(d *discordgo.Session, uMsg *discordgo.MessageCreate, attachment *discordgo.MessageAttachment) {
-	err := os.Mkdir("sounds", 0755)
-	if err != nil {
-		if !os.IsExist(err) {
-			_, err := d.ChannelMessageSend(uMsg.Message.ChannelID, "Error handling zip upload")
-			if err != nil {
-				panic(err)
-			}
-			return
-		}
-	}
-
-	filePath := filepath.Join("sounds", attachment.Filename)
-	err = downloadFile(attachment.Filename, attachment.URL)
-	checkError(err)
-
-	archive, err := zip.OpenReader(filePath)
-	if err != nil {
-		panic(err)
-	}
-	defer archive.Close()
-
-	for _, file := range archive.File {
-		if strings.Split(file.Name, ".")[1] != "mp3" {
-			return
-		}
-
-		fileReader, err := file.Open()
 		if err != nil {
-			panic(err)
+			logError("deleting message", err, "guild", uMsg.GuildID, "message", uMsg.ID)
 		}
-
-		filePath := "sounds/" + file.Name
-		fileWriter, err := os.Create(filePath)
-		if err != nil {
-			panic(err)
-		}
-
-		_, err = d.ChannelFileSend(uMsg.Message.ChannelID, file.Name, fileReader)
+		err = d.ChannelMessageDelete(uMsg.Message.ChannelID, warningMsg.ID)
 		if err != nil {
-			panic(err)
+			logError("deleting message", err, "guild", uMsg.GuildID, "message", warningMsg.ID)
 		}
-
-		soundName := strings.TrimSuffix(file.Name, ".mp3")
-		store[uMsg.GuildID].SoundList[soundName] = &Sound{
-			MessageID: uMsg.ID,
-			URL:       uMsg.Attachments[0].URL,
-		}
-
-		fileReader.Close()
-		fileWriter.Close()
 	}
-
-	err = os.RemoveAll("sounds")
-	checkError(err)
-
-	err = d.ChannelMessageDelete(uMsg.Message.ChannelID, uMsg.ID)
-	checkError(err)
 }
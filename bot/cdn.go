@@ -0,0 +1,202 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Discord's CDN signs attachment URLs and they expire (the "ex" parameter is when, in hex unix seconds), so a sound
+// loaded hours ago can have a URL that's refused by now. Reading a sound's file goes through withFreshURL, which
+// refreshes an expired URL before it's used and tries once more with a new URL when the CDN refuses it anyway.
+// The new URL only replaces the sound in memory, every rebuild reads them from the messages again
+
+// urlExpiryMargin refreshes URLs about to expire too, a sound shouldn't expire halfway through being read
+const urlExpiryMargin = 5 * time.Minute
+
+var refreshURLsEndpoint = discordgo.EndpointAPI + "attachments/refresh-urls"
+
+// errURLRefused means the CDN answered with 403 or 404, the URL expired (or the file is gone)
+var errURLRefused = errors.New("attachment url refused")
+
+// urlExpired is true when rawURL's signature expired or is about to, URLs without one never expire
+func urlExpired(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	expires, err := strconv.ParseInt(u.Query().Get("ex"), 16, 64)
+	if err != nil {
+		return false
+	}
+	return time.Now().Add(urlExpiryMargin).After(time.Unix(expires, 0))
+}
+
+// refusedOutput is true when ffmpeg's output says the CDN refused the URL
+func refusedOutput(output string) bool {
+	return strings.Contains(output, "403 Forbidden") || strings.Contains(output, "404 Not Found")
+}
+
+// withFreshURL calls read with the sound, refreshing its URL first if it expired, and again with a new URL if read
+// returns errURLRefused. It returns the sound read was called with last
+func withFreshURL(d *discordgo.Session, gState *GuildState, sound *Sound, read func(*Sound) error) (*Sound, error) {
+	sound = freshSound(d, gState, sound)
+	err := read(sound)
+	if !errors.Is(err, errURLRefused) {
+		return sound, err
+	}
+
+	slog.Debug("attachment url refused, refreshing it", "message", sound.MessageID)
+	refreshed, refreshErr := refreshSoundURL(d, gState, sound)
+	if refreshErr != nil {
+		return sound, errors.Join(err, refreshErr)
+	}
+	return refreshed, read(refreshed)
+}
+
+// freshSound is the sound with a new URL if its URL expired, for reads that can't tell a refused URL apart
+// (ffmpeg and ffprobe on their own). If that fails it's the sound as it was, the read fails on its own then
+func freshSound(d *discordgo.Session, gState *GuildState, sound *Sound) *Sound {
+	if !urlExpired(sound.URL) {
+		return sound
+	}
+	refreshed, err := refreshSoundURL(d, gState, sound)
+	if err != nil {
+		logError("refreshing attachment url", err, "message", sound.MessageID)
+		return sound
+	}
+	return refreshed
+}
+
+// refreshSoundURL gets the sound a new URL, from the refresh endpoint or else by reading its message again, and swaps
+// it into gState (nil when the guild isn't loaded). The returned sound has the new URL even if it's no longer in gState
+func refreshSoundURL(d *discordgo.Session, gState *GuildState, sound *Sound) (*Sound, error) {
+	newURL, err := refreshAttachmentURL(d, sound.URL)
+	if err != nil {
+		slog.Debug("refreshing attachment url failed, reading its message", "message", sound.MessageID, "err", err)
+		newURL, err = messageAttachmentURL(d, gState, sound)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if gState != nil {
+		if updated := gState.SetSoundURL(sound.MessageID, newURL); updated != nil {
+			return updated, nil
+		}
+	}
+	refreshed := *sound
+	refreshed.URL = newURL
+	return &refreshed, nil
+}
+
+// refreshAttachmentURL asks Discord to sign rawURL again
+func refreshAttachmentURL(d *discordgo.Session, rawURL string) (string, error) {
+	body, err := d.RequestWithBucketID(http.MethodPost, refreshURLsEndpoint, struct {
+		AttachmentURLs []string `json:"attachment_urls"`
+	}{[]string{rawURL}}, refreshURLsEndpoint)
+	if err != nil {
+		return "", err
+	}
+
+	var refreshed struct {
+		RefreshedURLs []struct {
+			Original  string `json:"original"`
+			Refreshed string `json:"refreshed"`
+		} `json:"refreshed_urls"`
+	}
+	err = json.Unmarshal(body, &refreshed)
+	if err != nil {
+		return "", err
+	}
+	if len(refreshed.RefreshedURLs) != 1 || refreshed.RefreshedURLs[0].Refreshed == "" {
+		return "", errors.New("no refreshed url in the response")
+	}
+	return refreshed.RefreshedURLs[0].Refreshed, nil
+}
+
+// messageAttachmentURL reads the URL of the sound's file from its message, fetching a message always signs it again.
+// A message can have several sounds' files, the sound's is the one with the attachment ID in its URL
+func messageAttachmentURL(d *discordgo.Session, gState *GuildState, sound *Sound) (string, error) {
+	if gState == nil {
+		return "", errGuildNotLoaded
+	}
+	message, err := d.ChannelMessage(gState.SoundsChannelID(), sound.MessageID)
+	if err != nil {
+		return "", err
+	}
+
+	id := attachmentID(sound.URL)
+	for _, attachment := range message.Attachments {
+		if attachment.ID == id {
+			return attachment.URL, nil
+		}
+	}
+	// without an ID to go by only a message with one file is certain
+	if id == "" && len(message.Attachments) == 1 {
+		return message.Attachments[0].URL, nil
+	}
+	return "", fmt.Errorf("%w: message %s doesn't have the sound's file", errSoundNotFound, sound.MessageID)
+}
+
+// fileID tells sounds apart by their file, an upload of several files has them all in one message.
+// It's the attachment ID, or the message ID for a URL without one
+func (s *Sound) fileID() string {
+	if id := attachmentID(s.URL); id != "" {
+		return id
+	}
+	return s.MessageID
+}
+
+// attachmentID is the attachment's ID in a CDN URL (/attachments/<channelID>/<attachmentID>/<file name>),
+// refreshing a URL keeps it. Empty if the URL isn't one of those
+func attachmentID(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) != 4 || parts[0] != "attachments" {
+		return ""
+	}
+	return parts[2]
+}
+
+// downloadSound gets the sound's file, the caller closes the body
+func downloadSound(ctx context.Context, d *discordgo.Session, gState *GuildState, sound *Sound) (*http.Response, error) {
+	var resp *http.Response
+	_, err := withFreshURL(d, gState, sound, func(sound *Sound) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, sound.URL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return nil
+		case http.StatusForbidden, http.StatusNotFound:
+			resp.Body.Close()
+			return fmt.Errorf("downloading sound: %w: %s", errURLRefused, resp.Status)
+		default:
+			resp.Body.Close()
+			return fmt.Errorf("downloading sound: %s", resp.Status)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,666 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// commandRequest is a command invocation, it looks the same whether it came from the commands channel or a slash command
+type commandRequest struct {
+	d         *discordgo.Session
+	GuildID   string
+	ChannelID string
+	User      *discordgo.User
+	Args      []string
+	spec      *commandSpec
+	gState    *GuildState
+	responder
+}
+
+// responder is how a command talks back to whoever called it
+type responder interface {
+	// Reply answers the user directly
+	Reply(content string) error
+	// Send posts a plain message, used for output that can take several messages (,list)
+	Send(content string) error
+	// Error tells only the user something went wrong (ephemeral for slash commands)
+	Error(content string) error
+	// Ack confirms a command that has no output of its own, comma commands stay quiet
+	Ack(content string) error
+	// Suggest answers with buttons the user can click instead of retyping the command
+	Suggest(content string, components []discordgo.MessageComponent) error
+	// SendFile answers with a file attached (,export)
+	SendFile(content string, name string, file io.Reader) error
+	// Preview answers with a file and buttons to do something with it (,trim)
+	Preview(content string, name string, file io.Reader, components []discordgo.MessageComponent) error
+}
+
+// commandSpec describes a command once for both the comma prefix and the slash command
+type commandSpec struct {
+	Command     Command
+	Name        string // slash command name
+	Usage       string
+	Description string
+	Options     []*discordgo.ApplicationCommandOption
+	Handler     func(req *commandRequest) error
+	// Deferred commands talk to discord a lot before answering, slash commands acknowledge them right away
+	Deferred bool
+}
+
+var commandSpecs []*commandSpec
+
+func init() {
+	soundOption := func(description string, required bool) *discordgo.ApplicationCommandOption {
+		return &discordgo.ApplicationCommandOption{
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "sound",
+			Description: description,
+			Required:    required,
+			// choices come from the guild's SoundList as the user types, see handleAutocomplete
+			Autocomplete: true,
+		}
+	}
+	minFade := 1.0
+
+	commandSpecs = []*commandSpec{
+		{
+			Command:     PlaySound,
+			Name:        "play",
+			Usage:       "<sound-name>",
+			Description: "Plays a sound",
+			Options:     []*discordgo.ApplicationCommandOption{soundOption("Sound to play", true)},
+			Handler:     handlePlaySound,
+		},
+		{
+			Command:     Connect,
+			Name:        "connect",
+			Description: "Connects to the voice channel you are in",
+			Handler:     handleConnect,
+		},
+		{
+			Command:     List,
+			Name:        "list",
+			Description: "Lists all sounds in the sounds channel",
+			Handler:     handleList,
+		},
+		{
+			Command:     SkipSound,
+			Name:        "skip",
+			Usage:       "[sound-name]",
+			Description: "Skips the current sound, with a sound name it plays that one next",
+			Options:     []*discordgo.ApplicationCommandOption{soundOption("Sound to play instead", false)},
+			Handler:     handleSkipSound,
+		},
+		{
+			Command:     Queue,
+			Name:        "queue",
+			Description: "Lists the sounds waiting to be played",
+			Handler:     handleQueue,
+		},
+		{
+			Command:     Clear,
+			Name:        "clear",
+			Description: "Empties the queue",
+			Handler:     handleClear,
+		},
+		{
+			Command:     Rename,
+			Name:        "rename",
+			Usage:       "<current-name> <new-name>",
+			Description: "Renames a sound",
+			Options: []*discordgo.ApplicationCommandOption{
+				soundOption("Sound to rename", true),
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "new-name",
+					Description: "New name for the sound",
+					Required:    true,
+				},
+			},
+			Handler:  handleRename,
+			Deferred: true,
+		},
+		{
+			Command:     AddEntrance,
+			Name:        "addentrance",
+			Usage:       "<sound-name>",
+			Description: "Sets a sound as your entrance sound",
+			Options:     []*discordgo.ApplicationCommandOption{soundOption("Sound to play when you join voice", true)},
+			Handler:     handleAddEntrance,
+			Deferred:    true,
+		},
+		{
+			Command:     Adjustvol,
+			Name:        "adjustvol",
+			Usage:       "<sound-name> <percent|reset>",
+			Description: "Adjusts the volume of a sound in percent of the original (0-200), reset puts it back",
+			Options: []*discordgo.ApplicationCommandOption{
+				soundOption("Sound to adjust", true),
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "volume",
+					Description: "0-200, 100 is the original volume, or reset",
+					Required:    true,
+				},
+			},
+			Handler:  handleAdjustvol,
+			Deferred: true,
+		},
+		{
+			Command:     MasterVolume,
+			Name:        "mastervolume",
+			Usage:       "[percent|reset]",
+			Description: "Shows or sets the volume every sound plays at (0-200), setting it needs the Manage Server permission",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "volume",
+					Description: "0-200, 100 is the default (-20% is 80), or reset",
+				},
+			},
+			Handler:  handleMasterVolume,
+			Deferred: true,
+		},
+		{
+			Command:     MyVolume,
+			Name:        "myvolume",
+			Usage:       "[percent|reset]",
+			Description: "Shows or sets how loud the sounds you play are, like -20% for all of them",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "volume",
+					Description: "0-200, 100 is the default (-20% is 80), or reset",
+				},
+			},
+			Handler:  handleMyVolume,
+			Deferred: true,
+		},
+		{
+			Command:     Find,
+			Name:        "find",
+			Usage:       "<sound-name>",
+			Description: "Finds a sound by name and returns a link to it",
+			Options:     []*discordgo.ApplicationCommandOption{soundOption("Sound to find", true)},
+			Handler:     handleFind,
+		},
+		{
+			Command:     Trim,
+			Name:        "trim",
+			Usage:       "<sound-name> <start> <end>",
+			Description: "Cuts a sound down to the part between start and end (seconds or minutes:seconds), with a preview first",
+			Options: []*discordgo.ApplicationCommandOption{
+				soundOption("Sound to trim", true),
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "start",
+					Description: "Where the sound starts, like 1.5 or 0:01.5",
+					Required:    true,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "end",
+					Description: "Where the sound ends, like 4 or 0:04",
+					Required:    true,
+				},
+			},
+			Handler:  handleTrim,
+			Deferred: true,
+		},
+		{
+			Command:     Fade,
+			Name:        "fade",
+			Usage:       "<sound-name> <in|out> <ms>",
+			Description: "Fades a sound in or out over some milliseconds, with a preview first",
+			Options: []*discordgo.ApplicationCommandOption{
+				soundOption("Sound to fade", true),
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "direction",
+					Description: "Fade in at the start or out at the end",
+					Required:    true,
+					Choices: []*discordgo.ApplicationCommandOptionChoice{
+						{Name: "in", Value: "in"},
+						{Name: "out", Value: "out"},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "ms",
+					Description: "How long the fade takes in milliseconds",
+					Required:    true,
+					MinValue:    &minFade,
+				},
+			},
+			Handler:  handleFade,
+			Deferred: true,
+		},
+		{
+			Command:     Export,
+			Name:        "export",
+			Description: "Exports every sound as a zip, uploading it to the sounds channel restores them",
+			Handler:     handleExport,
+			Deferred:    true,
+		},
+		{
+			Command:     Help,
+			Name:        "help",
+			Description: "Shows this message",
+			Handler:     handleHelp,
+		},
+	}
+}
+
+// commandByPrefix finds the command for a "<prefix><command>" word
+func commandByPrefix(word string) *commandSpec {
+	command, ok := strings.CutPrefix(word, config.CommandPrefix)
+	if !ok {
+		return nil
+	}
+	for _, spec := range commandSpecs {
+		if string(spec.Command) == command {
+			return spec
+		}
+	}
+	return nil
+}
+
+func commandBySlashName(name string) *commandSpec {
+	for _, spec := range commandSpecs {
+		if spec.Name == name {
+			return spec
+		}
+	}
+	return nil
+}
+
+// usage is how the command is typed in the commands channel
+func (spec *commandSpec) usage() string {
+	return strings.TrimSpace(config.CommandPrefix + string(spec.Command) + " " + spec.Usage)
+}
+
+// requiredArgs is the number of arguments a command can't run without
+func (spec *commandSpec) requiredArgs() int {
+	n := 0
+	for _, option := range spec.Options {
+		if option.Required {
+			n++
+		}
+	}
+	return n
+}
+
+func (spec *commandSpec) applicationCommand() *discordgo.ApplicationCommand {
+	return &discordgo.ApplicationCommand{
+		Name:        spec.Name,
+		Description: spec.Description,
+		Options:     spec.Options,
+	}
+}
+
+func runCommand(spec *commandSpec, req *commandRequest) {
+	req.spec = spec
+	if isShuttingDown() {
+		req.fail(userErrorf("The bot is restarting, try again in a bit"))
+		return
+	}
+	if len(req.Args) < spec.requiredArgs() {
+		req.fail(userErrorf("Usage: `%s`", spec.usage()))
+		return
+	}
+	gState, ok := store.Guild(req.GuildID)
+	if !ok {
+		req.fail(fmt.Errorf("guild %s: %w", req.GuildID, errGuildNotLoaded))
+		return
+	}
+
+	req.gState = gState
+	err := callRecovered(func() error {
+		return spec.Handler(req)
+	})
+	if err != nil && !errors.Is(err, errAnswered) {
+		req.fail(err)
+	}
+}
+
+// fail logs what went wrong (unless it was the user's doing) and tells the user about it
+func (req *commandRequest) fail(err error) {
+	if !expectedError(err) {
+		logError("command failed", err, "command", req.spec.Name, "guild", req.GuildID, "user", req.User.ID)
+	}
+
+	replyErr := req.Error(userMessage(err))
+	if replyErr != nil {
+		logError("sending error reply", replyErr, "command", req.spec.Name, "guild", req.GuildID)
+	}
+}
+
+// lookupSound resolves the sound in the first argument, when it can't settle on one it
+// replies with "did you mean" buttons and returns errAnswered
+func (req *commandRequest) lookupSound() (string, *Sound, error) {
+	name, sound, candidates := resolveSound(req.gState.Sounds(), req.Args[0])
+	if sound != nil {
+		return name, sound, nil
+	}
+
+	if len(candidates) == 0 {
+		return "", nil, fmt.Errorf("%w: %q", errSoundNotFound, req.Args[0])
+	}
+
+	buttons := make([]discordgo.MessageComponent, 0, len(candidates))
+	for _, candidate := range candidates {
+		args := append([]string{candidate}, req.Args[1:]...)
+		customID := suggestionCustomID(req.spec, args)
+		// discord caps custom ids at 100 characters
+		if len(customID) > 100 {
+			continue
+		}
+		buttons = append(buttons, discordgo.Button{
+			Label:    candidate,
+			Style:    discordgo.SecondaryButton,
+			CustomID: customID,
+		})
+	}
+
+	if len(buttons) == 0 {
+		return "", nil, userErrorf("Sound not found, did you mean: %s", strings.Join(candidates, ", "))
+	}
+
+	err := req.Suggest("Sound not found, did you mean:", []discordgo.MessageComponent{
+		discordgo.ActionsRow{Components: buttons},
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return "", nil, errAnswered
+}
+
+// messageResponder answers comma commands in the channel they were sent in
+type messageResponder struct {
+	d    *discordgo.Session
+	uMsg *discordgo.MessageCreate
+}
+
+func (m *messageResponder) Reply(content string) error {
+	_, err := m.d.ChannelMessageSendReply(m.uMsg.ChannelID, content, m.uMsg.Reference())
+	return err
+}
+
+func (m *messageResponder) Send(content string) error {
+	_, err := m.d.ChannelMessageSend(m.uMsg.ChannelID, content)
+	return err
+}
+
+func (m *messageResponder) Error(content string) error {
+	_, err := m.d.ChannelMessageSend(m.uMsg.ChannelID, content)
+	return err
+}
+
+func (m *messageResponder) Ack(string) error {
+	return nil
+}
+
+func (m *messageResponder) Suggest(content string, components []discordgo.MessageComponent) error {
+	_, err := m.d.ChannelMessageSendComplex(m.uMsg.ChannelID, &discordgo.MessageSend{
+		Content:    content,
+		Components: components,
+		Reference:  m.uMsg.Reference(),
+	})
+	return err
+}
+
+func (m *messageResponder) SendFile(content string, name string, file io.Reader) error {
+	_, err := m.d.ChannelMessageSendComplex(m.uMsg.ChannelID, &discordgo.MessageSend{
+		Content:   content,
+		Files:     []*discordgo.File{{Name: name, Reader: file}},
+		Reference: m.uMsg.Reference(),
+	})
+	return err
+}
+
+func (m *messageResponder) Preview(content string, name string, file io.Reader, components []discordgo.MessageComponent) error {
+	_, err := m.d.ChannelMessageSendComplex(m.uMsg.ChannelID, &discordgo.MessageSend{
+		Content:    content,
+		Files:      []*discordgo.File{{Name: name, Reader: file}},
+		Components: components,
+		Reference:  m.uMsg.Reference(),
+	})
+	return err
+}
+
+func handleCommandsChannel(d *discordgo.Session, uMsg *discordgo.MessageCreate) {
+	if len(uMsg.Attachments) > 0 {
+		return
+	}
+
+	fields := strings.Fields(uMsg.Content)
+	if len(fields) == 0 {
+		return
+	}
+
+	spec := commandByPrefix(fields[0])
+	if spec == nil {
+		return
+	}
+
+	runCommand(spec, &commandRequest{
+		d:         d,
+		GuildID:   uMsg.GuildID,
+		ChannelID: uMsg.ChannelID,
+		User:      uMsg.Author,
+		Args:      fields[1:],
+		responder: &messageResponder{d: d, uMsg: uMsg},
+	})
+}
+
+func helpMessage() string {
+	formattedMessage := "### To add sounds, just send them to the '" + config.SoundsChannel + "' channel as a message (just the file, no text)\n" +
+		"**Commands:** (also available as slash commands)\n"
+	for _, spec := range commandSpecs {
+		if spec.Command == Help {
+			continue
+		}
+		formattedMessage += "`" + spec.usage() + "` " + spec.Description + ".\n"
+	}
+	return formattedMessage
+}
+
+func handleHelp(req *commandRequest) error {
+	return req.Send(helpMessage())
+}
+
+func handleConnect(req *commandRequest) error {
+	voiceState, err := req.d.State.VoiceState(req.GuildID, req.User.ID)
+	if err != nil {
+		return userErrorf("You need to be in a voice channel")
+	}
+
+	v, err := req.d.ChannelVoiceJoin(req.GuildID, voiceState.ChannelID, false, false)
+	if err != nil {
+		return failed("Error joining voice channel", err)
+	}
+
+	if v == nil {
+		return userErrorf("You need to be in a voice channel")
+	}
+	return req.Ack("Connected")
+}
+
+func handleRename(req *commandRequest) error {
+	newName := req.Args[1]
+	searchTerm, _, err := req.lookupSound()
+	if err != nil {
+		return err
+	}
+
+	_, err = renameSound(req.d, req.GuildID, req.gState, searchTerm, newName)
+	if err != nil {
+		return err
+	}
+	return req.Reply("Sound renamed")
+}
+
+func handleAddEntrance(req *commandRequest) error {
+	searchTerm, _, err := req.lookupSound()
+	if err != nil {
+		return err
+	}
+
+	_, err = setEntrance(req.d, req.GuildID, req.gState, req.User.ID, searchTerm)
+	if err != nil {
+		return err
+	}
+	return req.Reply("Entrance set")
+}
+
+func handleAdjustvol(req *commandRequest) error {
+	volume, err := parseVolume(req.Args[1])
+	if err != nil {
+		return err
+	}
+
+	searchTerm, _, err := req.lookupSound()
+	if err != nil {
+		return err
+	}
+
+	_, err = setSoundVolume(req.d, req.GuildID, req.gState, searchTerm, volume)
+	if err != nil {
+		return err
+	}
+	if volume == nil {
+		return req.Reply("Volume reset")
+	}
+	return req.Reply("Volume adjusted")
+}
+
+// parseVolume reads a volume in percent ("80" or "80%", "-20%" is also 80), "reset" is nil
+func parseVolume(arg string) (*int, error) {
+	if strings.EqualFold(arg, "reset") {
+		return nil, nil
+	}
+	volume, err := strconv.Atoi(strings.TrimSuffix(arg, "%"))
+	if strings.HasPrefix(arg, "-") || strings.HasPrefix(arg, "+") {
+		volume += defaultVolume
+	}
+	if err != nil || volume < 0 || volume > maxVolume {
+		return nil, userErrorf("Volume must be between 0 and %d%% (100 is the original volume), or reset", maxVolume)
+	}
+	return &volume, nil
+}
+
+func handleFind(req *commandRequest) error {
+	searchTerm, sound, err := req.lookupSound()
+	if err != nil {
+		return err
+	}
+
+	messageLink := "https://discordapp.com/channels/" + req.GuildID + "/" + req.gState.SoundsChannelID() + "/" + sound.MessageID
+	messageMarkdown := "Found this: [" + searchTerm + "](" + messageLink + ")"
+	return req.Reply(messageMarkdown)
+}
+
+func handlePlaySound(req *commandRequest) error {
+	if req.gState.SoundCount() == 0 {
+		return userErrorf("No sounds loaded")
+	}
+
+	voiceState, err := req.d.State.VoiceState(req.GuildID, req.User.ID)
+	if err != nil || voiceState.ChannelID == "" {
+		return userErrorf("You need to be in a voice channel")
+	}
+
+	//lookup sound locally only, upload or boot should assure it's either here or nowhere
+	searchTerm, _, err := req.lookupSound()
+	if err != nil {
+		return err
+	}
+
+	_, pos, err := queueSound(req.gState, searchTerm, voiceState.ChannelID, req.User.ID)
+	if err != nil {
+		return err
+	}
+	return req.Ack(fmt.Sprintf("Queued %s (#%d)", searchTerm, pos))
+}
+
+// handleSkipSound skips only the sound that's playing, ,ss <sound-name> also puts that sound at the front of the queue
+func handleSkipSound(req *commandRequest) error {
+	if len(req.Args) == 0 {
+		if req.gState.Queue.Skip() {
+			return req.Ack("Skipped")
+		}
+		return req.Ack("Nothing is playing")
+	}
+
+	searchTerm, sound, err := req.lookupSound()
+	if err != nil {
+		return err
+	}
+
+	voiceState, err := req.d.State.VoiceState(req.GuildID, req.User.ID)
+	if err != nil || voiceState.ChannelID == "" {
+		return userErrorf("You need to be in a voice channel")
+	}
+
+	skipped := req.gState.Queue.SkipTo(&QueueItem{
+		Name:        searchTerm,
+		Sound:       sound,
+		ChannelID:   voiceState.ChannelID,
+		RequestedBy: req.User.ID,
+	})
+	if skipped {
+		return req.Ack("Skipped")
+	}
+	return req.Ack("Playing " + searchTerm + " next")
+}
+
+func handleQueue(req *commandRequest) error {
+	current, pending := req.gState.Queue.Snapshot()
+	return req.Send(formatQueue(current, pending))
+}
+
+func handleClear(req *commandRequest) error {
+	cleared := req.gState.Queue.Clear()
+	return req.Reply(fmt.Sprintf("Removed %d sounds from the queue", cleared))
+}
+
+func handleList(req *commandRequest) error {
+	// shoutout rasmussy
+	soundNames := req.gState.SoundNames()
+	sList := req.gState.Sounds()
+
+	listOutput := "```(" + fmt.Sprint(len(soundNames)) + ") " + "Available sounds :\n------------------\n\n"
+	nb := 0
+	for _, name := range soundNames {
+		nb += 1
+		var soundName = name
+		if sound, ok := sList[name]; ok {
+			soundName += " (" + sound.format() + ")"
+		}
+		for len(soundName) < 22 {
+			soundName += " "
+		}
+		listOutput += soundName + "\t"
+		if nb%5 == 0 {
+			listOutput += "\n"
+		}
+		// Discord max message length is 2000
+		if len(listOutput) > 1950 { // removed condition for max sounds printed
+			listOutput += "```"
+			if err := req.Send(listOutput); err != nil {
+				return err
+			}
+			listOutput = "```"
+		}
+	}
+	listOutput += "```"
+	if listOutput != "``````" {
+		return req.Send(listOutput)
+	}
+	return nil
+}
@@ -0,0 +1,337 @@
+package bot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is everything that can differ between deployments.
+// LoadConfig starts from the defaults, applies the optional JSON file and then the environment, so env always wins
+type Config struct {
+	// Token is the bot token (BOT_TOKEN)
+	Token string `json:"token"`
+
+	// ListenAddr is where the HTTP server listens (LISTEN_ADDR)
+	ListenAddr string `json:"listenAddr"`
+	// TLSCertFile and TLSKeyFile serve HTTPS when both are set (TLS_CERT_FILE, TLS_KEY_FILE)
+	TLSCertFile string `json:"tlsCertFile"`
+	TLSKeyFile  string `json:"tlsKeyFile"`
+	// AllowedOrigins are the frontends allowed to call the HTTP API (CORS_ORIGINS, comma separated)
+	AllowedOrigins []string `json:"allowedOrigins"`
+
+	// SoundsChannel and CommandsChannel are the names of the channels the bot works in (SOUNDS_CHANNEL, COMMANDS_CHANNEL)
+	SoundsChannel   string `json:"soundsChannel"`
+	CommandsChannel string `json:"commandsChannel"`
+	// CommandPrefix goes in front of every command in the commands channel (COMMAND_PREFIX)
+	CommandPrefix string `json:"commandPrefix"`
+
+	// AllowedFormats are the file extensions accepted for new uploads, out of mp3, ogg, opus, wav, flac, m4a and webm (AUDIO_FORMATS, comma separated)
+	// sounds already saved load in any of those
+	AllowedFormats []string `json:"allowedFormats"`
+	// MaxSoundDuration and MaxSoundSizeMB are how long and big an upload can be (MAX_SOUND_DURATION, e.g. "1m", MAX_SOUND_SIZE_MB)
+	MaxSoundDuration Duration `json:"maxSoundDuration"`
+	MaxSoundSizeMB   int      `json:"maxSoundSizeMb"`
+	// Normalize plays every sound at TargetLoudness (in LUFS) instead of however loud it was uploaded (NORMALIZE, TARGET_LOUDNESS)
+	Normalize      bool    `json:"normalize"`
+	TargetLoudness float64 `json:"targetLoudness"`
+
+	// Bitrate is the opus bitrate in kb/s sounds are encoded at (BITRATE)
+	Bitrate int `json:"bitrate"`
+	// RebuildInterval is how often every guild is reconciled with its sounds channel (REBUILD_INTERVAL, e.g. "4h")
+	RebuildInterval Duration `json:"rebuildInterval"`
+
+	// StoreBackend picks where sounds and their metadata are persisted, "discord" or "bolt" (STORE_BACKEND)
+	StoreBackend string `json:"storeBackend"`
+	// StorePath is the database file used by the bolt backend (STORE_PATH)
+	StorePath string `json:"storePath"`
+	// CacheDir keeps encoded sounds so they don't go through ffmpeg on every play, up to CacheSizeMB (0 turns it off)
+	// (CACHE_DIR, CACHE_SIZE_MB)
+	CacheDir    string `json:"cacheDir"`
+	CacheSizeMB int    `json:"cacheSizeMb"`
+
+	// OAuthClientID and OAuthClientSecret are the application's OAuth2 credentials, login is disabled without them
+	// (DISCORD_CLIENT_ID, DISCORD_CLIENT_SECRET)
+	OAuthClientID     string `json:"oauthClientId"`
+	OAuthClientSecret string `json:"oauthClientSecret"`
+	// OAuthRedirectURL is where Discord sends the user back to, it has to point at /auth/callback (OAUTH_REDIRECT_URL)
+	OAuthRedirectURL string `json:"oauthRedirectUrl"`
+	// FrontendURL is where the user lands after logging in (FRONTEND_URL)
+	FrontendURL string `json:"frontendUrl"`
+	// APITokenSecret signs per guild API tokens, tokens are disabled without it and changing it revokes every token (API_TOKEN_SECRET)
+	APITokenSecret string `json:"apiTokenSecret"`
+}
+
+// Duration reads "4h"/"30m" style durations from the config file
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// config is set once by Run before anything else starts and only read after that
+var config = DefaultConfig()
+
+func DefaultConfig() Config {
+	return Config{
+		ListenAddr:       ":8080",
+		AllowedOrigins:   []string{"https://gleaming-exploration-production.up.railway.app"},
+		SoundsChannel:    "sounds",
+		CommandsChannel:  "bot-commands",
+		CommandPrefix:    ",",
+		AllowedFormats:   slices.Clone(knownFormats),
+		MaxSoundDuration: Duration(time.Minute),
+		MaxSoundSizeMB:   uploadLimit >> 20,
+		Normalize:        true,
+		TargetLoudness:   -16,
+		Bitrate:          32,
+		RebuildInterval:  Duration(4 * time.Hour),
+		StoreBackend:     "discord",
+		StorePath:        "ebening.db",
+		CacheDir:         "frame-cache",
+		CacheSizeMB:      512,
+	}
+}
+
+// LoadConfig reads the config file at path (if path isn't empty) and the environment, then validates the result
+// empty environment variables are ignored
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("reading config file: %w", err)
+		}
+		err = json.Unmarshal(data, &cfg)
+		if err != nil {
+			return cfg, fmt.Errorf("parsing config file %s: %w", path, err)
+		}
+	}
+
+	err := cfg.applyEnv()
+	if err != nil {
+		return cfg, err
+	}
+	// ".MP3" and "mp3" are the same format
+	for i, format := range cfg.AllowedFormats {
+		cfg.AllowedFormats[i] = strings.ToLower(strings.TrimPrefix(format, "."))
+	}
+	return cfg, cfg.Validate()
+}
+
+func (cfg *Config) applyEnv() error {
+	stringVars := map[string]*string{
+		"BOT_TOKEN":             &cfg.Token,
+		"LISTEN_ADDR":           &cfg.ListenAddr,
+		"TLS_CERT_FILE":         &cfg.TLSCertFile,
+		"TLS_KEY_FILE":          &cfg.TLSKeyFile,
+		"SOUNDS_CHANNEL":        &cfg.SoundsChannel,
+		"COMMANDS_CHANNEL":      &cfg.CommandsChannel,
+		"COMMAND_PREFIX":        &cfg.CommandPrefix,
+		"STORE_BACKEND":         &cfg.StoreBackend,
+		"STORE_PATH":            &cfg.StorePath,
+		"CACHE_DIR":             &cfg.CacheDir,
+		"DISCORD_CLIENT_ID":     &cfg.OAuthClientID,
+		"DISCORD_CLIENT_SECRET": &cfg.OAuthClientSecret,
+		"OAUTH_REDIRECT_URL":    &cfg.OAuthRedirectURL,
+		"FRONTEND_URL":          &cfg.FrontendURL,
+		"API_TOKEN_SECRET":      &cfg.APITokenSecret,
+	}
+	for key, field := range stringVars {
+		if value := os.Getenv(key); value != "" {
+			*field = value
+		}
+	}
+
+	if value := os.Getenv("CORS_ORIGINS"); value != "" {
+		cfg.AllowedOrigins = splitList(value)
+	}
+	if value := os.Getenv("AUDIO_FORMATS"); value != "" {
+		cfg.AllowedFormats = splitList(value)
+	}
+	if value := os.Getenv("MAX_SOUND_DURATION"); value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("MAX_SOUND_DURATION: %w", err)
+		}
+		cfg.MaxSoundDuration = Duration(duration)
+	}
+	if value := os.Getenv("MAX_SOUND_SIZE_MB"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("MAX_SOUND_SIZE_MB: %w", err)
+		}
+		cfg.MaxSoundSizeMB = size
+	}
+	if value := os.Getenv("CACHE_SIZE_MB"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("CACHE_SIZE_MB: %w", err)
+		}
+		cfg.CacheSizeMB = size
+	}
+	if value := os.Getenv("NORMALIZE"); value != "" {
+		normalize, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("NORMALIZE: %w", err)
+		}
+		cfg.Normalize = normalize
+	}
+	if value := os.Getenv("TARGET_LOUDNESS"); value != "" {
+		loudness, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("TARGET_LOUDNESS: %w", err)
+		}
+		cfg.TargetLoudness = loudness
+	}
+	if value := os.Getenv("BITRATE"); value != "" {
+		bitrate, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("BITRATE: %w", err)
+		}
+		cfg.Bitrate = bitrate
+	}
+	if value := os.Getenv("REBUILD_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("REBUILD_INTERVAL: %w", err)
+		}
+		cfg.RebuildInterval = Duration(interval)
+	}
+	return nil
+}
+
+// Validate reports every problem with the config at once
+func (cfg Config) Validate() error {
+	var errs []error
+	invalid := func(format string, a ...any) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+
+	if cfg.Token == "" {
+		invalid("token (BOT_TOKEN) is required")
+	}
+	if cfg.ListenAddr == "" {
+		invalid("listenAddr can't be empty")
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		invalid("tlsCertFile and tlsKeyFile have to be set together")
+	}
+	for _, file := range []string{cfg.TLSCertFile, cfg.TLSKeyFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			invalid("tls file: %w", err)
+		}
+	}
+	for _, origin := range cfg.AllowedOrigins {
+		if origin == "*" {
+			// the API answers with credentials, any site could read a logged in visitor's guilds
+			invalid("allowed origins can't be \"*\", list the frontends")
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			invalid("allowed origin %q should look like https://example.com", origin)
+		}
+	}
+
+	if cfg.SoundsChannel == "" || cfg.CommandsChannel == "" {
+		invalid("soundsChannel and commandsChannel can't be empty")
+	}
+	if cfg.SoundsChannel == cfg.CommandsChannel {
+		invalid("soundsChannel and commandsChannel have to be different channels")
+	}
+	if cfg.CommandPrefix == "" || strings.ContainsAny(cfg.CommandPrefix, " \t\n") {
+		invalid("commandPrefix can't be empty or have spaces")
+	}
+
+	if len(cfg.AllowedFormats) == 0 {
+		invalid("allowedFormats can't be empty")
+	}
+	for _, format := range cfg.AllowedFormats {
+		if !slices.Contains(knownFormats, format) {
+			invalid("unsupported audio format %q, pick from %s", format, strings.Join(knownFormats, ", "))
+		}
+	}
+
+	if time.Duration(cfg.MaxSoundDuration) < time.Second {
+		invalid("maxSoundDuration has to be at least 1s, got %s", time.Duration(cfg.MaxSoundDuration))
+	}
+	if cfg.MaxSoundSizeMB < 1 || cfg.MaxSoundSizeMB > 100 {
+		invalid("maxSoundSizeMb has to be between 1 and 100, got %d", cfg.MaxSoundSizeMB)
+	}
+	if cfg.TargetLoudness < -40 || cfg.TargetLoudness > -5 {
+		invalid("targetLoudness has to be between -40 and -5 LUFS, got %g", cfg.TargetLoudness)
+	}
+
+	if cfg.Bitrate < 8 || cfg.Bitrate > 384 {
+		invalid("bitrate has to be between 8 and 384 kb/s, got %d", cfg.Bitrate)
+	}
+	if time.Duration(cfg.RebuildInterval) < time.Minute {
+		invalid("rebuildInterval has to be at least 1m, got %s", time.Duration(cfg.RebuildInterval))
+	}
+
+	if cfg.StoreBackend != "discord" && cfg.StoreBackend != "bolt" {
+		invalid("unknown store backend %q", cfg.StoreBackend)
+	}
+	if cfg.StoreBackend == "bolt" && cfg.StorePath == "" {
+		invalid("storePath is required with the bolt backend")
+	}
+	if cfg.CacheSizeMB < 0 {
+		invalid("cacheSizeMb can't be negative, 0 turns the cache off")
+	}
+	if cfg.CacheSizeMB > 0 && cfg.CacheDir == "" {
+		invalid("cacheDir is required unless cacheSizeMb is 0")
+	}
+
+	if (cfg.OAuthClientID == "") != (cfg.OAuthClientSecret == "") {
+		invalid("oauthClientId and oauthClientSecret have to be set together")
+	}
+	if cfg.OAuthClientID != "" && cfg.OAuthRedirectURL == "" {
+		invalid("oauthRedirectUrl is required for login")
+	}
+
+	return errors.Join(errs...)
+}
+
+// allowsOrigin is true if the frontend at origin may call the HTTP API
+func (cfg Config) allowsOrigin(origin string) bool {
+	for _, allowed := range cfg.AllowedOrigins {
+		if strings.TrimSuffix(allowed, "/") == origin {
+			return true
+		}
+	}
+	return false
+}
+
+func splitList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
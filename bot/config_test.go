@@ -0,0 +1,94 @@
+package bot
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validConfig is the defaults with everything that has no default filled in
+func validConfig() Config {
+	cfg := DefaultConfig()
+	cfg.Token = "token"
+	return cfg
+}
+
+func TestDefaultConfigNeedsOnlyAToken(t *testing.T) {
+	if err := validConfig().Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	if err := DefaultConfig().Validate(); err == nil || !strings.Contains(err.Error(), "BOT_TOKEN") {
+		t.Errorf("Validate() without a token = %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(cfg *Config)
+		// want is part of the error, empty if the config is fine
+		want string
+	}{
+		{"any origin", func(cfg *Config) { cfg.AllowedOrigins = []string{"https://example.com", "*"} }, `can't be "*"`},
+		{"origin without scheme", func(cfg *Config) { cfg.AllowedOrigins = []string{"example.com"} }, `"example.com" should look like`},
+		{"origin with path", func(cfg *Config) { cfg.AllowedOrigins = []string{"https://example.com/app"} }, "should look like"},
+		{"origin with slash", func(cfg *Config) { cfg.AllowedOrigins = []string{"http://localhost:5173/"} }, ""},
+		{"no origins", func(cfg *Config) { cfg.AllowedOrigins = nil }, ""},
+		{"tls cert alone", func(cfg *Config) { cfg.TLSCertFile = "cert.pem" }, "set together"},
+		{"missing tls files", func(cfg *Config) {
+			cfg.TLSCertFile = filepath.Join(t.TempDir(), "cert.pem")
+			cfg.TLSKeyFile = filepath.Join(t.TempDir(), "key.pem")
+		}, "tls file"},
+		{"same channels", func(cfg *Config) { cfg.CommandsChannel = cfg.SoundsChannel }, "different channels"},
+		{"prefix with space", func(cfg *Config) { cfg.CommandPrefix = "! " }, "commandPrefix"},
+		{"no formats", func(cfg *Config) { cfg.AllowedFormats = nil }, "allowedFormats can't be empty"},
+		{"unknown format", func(cfg *Config) { cfg.AllowedFormats = []string{"mp3", "aiff"} }, `"aiff"`},
+		{"some formats", func(cfg *Config) { cfg.AllowedFormats = []string{"ogg", "opus"} }, ""},
+		{"short sounds", func(cfg *Config) { cfg.MaxSoundDuration = Duration(500 * time.Millisecond) }, "at least 1s"},
+		{"long sounds", func(cfg *Config) { cfg.MaxSoundDuration = Duration(10 * time.Minute) }, ""},
+		{"no size", func(cfg *Config) { cfg.MaxSoundSizeMB = 0 }, "maxSoundSizeMb"},
+		{"too big", func(cfg *Config) { cfg.MaxSoundSizeMB = 101 }, "maxSoundSizeMb"},
+		{"too quiet", func(cfg *Config) { cfg.TargetLoudness = -41 }, "targetLoudness"},
+		{"too loud", func(cfg *Config) { cfg.TargetLoudness = 0 }, "targetLoudness"},
+		{"bitrate", func(cfg *Config) { cfg.Bitrate = 4 }, "bitrate"},
+		{"rebuild interval", func(cfg *Config) { cfg.RebuildInterval = Duration(time.Second) }, "rebuildInterval"},
+		{"unknown backend", func(cfg *Config) { cfg.StoreBackend = "sqlite" }, `"sqlite"`},
+		{"bolt without path", func(cfg *Config) { cfg.StoreBackend, cfg.StorePath = "bolt", "" }, "storePath"},
+		{"negative cache", func(cfg *Config) { cfg.CacheSizeMB = -1 }, "can't be negative"},
+		{"cache without dir", func(cfg *Config) { cfg.CacheDir = "" }, "cacheDir"},
+		{"cache off without dir", func(cfg *Config) { cfg.CacheDir, cfg.CacheSizeMB = "", 0 }, ""},
+		{"oauth id alone", func(cfg *Config) { cfg.OAuthClientID = "id" }, "set together"},
+		{"oauth without redirect", func(cfg *Config) { cfg.OAuthClientID, cfg.OAuthClientSecret = "id", "secret" }, "oauthRedirectUrl"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig()
+			tt.change(&cfg)
+			err := cfg.Validate()
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("Validate() = %v, want no error", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Errorf("Validate() = %v, want an error about %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	cfg := validConfig()
+	cfg.Token = ""
+	cfg.AllowedOrigins = []string{"*"}
+	cfg.AllowedFormats = []string{"aiff"}
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("Validate() accepted the config")
+	}
+	for _, want := range []string{"BOT_TOKEN", `"*"`, `"aiff"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() = %v, want it to mention %s", err, want)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package bot
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// an upload whose name is taken or whose file is already a sound waits for the uploader to pick what happens to it,
+// the buttons' custom id is "upload <choice> <AttachmentID>"
+const uploadChoicePrefix = "upload"
+
+const (
+	choiceReplace = "replace"
+	choiceSuffix  = "suffix"
+	choiceKeep    = "keep"
+	choiceReject  = "reject"
+)
+
+// uploadChoiceTTL is how long the uploader has to choose, nobody choosing rejects the upload
+const uploadChoiceTTL = 10 * time.Minute
+
+// maxHashSize is the most that gets downloaded to hash a sound
+const maxHashSize = 100 << 20
+
+type pendingUpload struct {
+	guildID   string
+	channelID string
+	messageID string
+	userID    string
+	name      string
+	sound     *Sound
+	// duplicate is the sound with the same content, if any
+	duplicate string
+	// promptID is the message with the buttons
+	promptID string
+	timer    *time.Timer
+}
+
+// pendingUploads [AttachmentID] are uploads waiting for a choice, they're only kept in memory
+var pendingUploads = struct {
+	sync.Mutex
+	uploads map[string]*pendingUpload
+}{uploads: make(map[string]*pendingUpload)}
+
+// soundHashes [fileID] caches hashes of sounds loaded without one (see Sound.fileID)
+var soundHashes sync.Map
+
+// handleUpload adds a sound uploaded to the sounds channel once it passes validateUpload, unless its name is taken
+// or it's a copy of another sound, then the uploader gets buttons to replace the old sound, keep both (under a new name)
+// or reject the upload
+func handleUpload(d *discordgo.Session, uMsg *discordgo.MessageCreate, gState *GuildState, attachment *discordgo.MessageAttachment, name string, sound *Sound) {
+	info, err := validateUpload(attachment)
+	if err != nil {
+		rejectUpload(d, uMsg, attachment, err)
+		return
+	}
+	sound.Loudness = info.Loudness
+	sound.Peak = info.Peak
+
+	hash, err := hashSound(d, gState, sound)
+	if err != nil {
+		// not being able to check for copies shouldn't lose the upload
+		logError("hashing upload", err, "guild", uMsg.GuildID, "file", attachment.Filename)
+	}
+	sound.Hash = hash
+
+	_, nameTaken := gState.Sound(name)
+	duplicate := findDuplicate(d, gState, sound)
+	if !nameTaken && duplicate == "" {
+		err = addSound(d, uMsg.GuildID, gState, name, sound)
+		if err != nil {
+			logError("saving sound", err, "guild", uMsg.GuildID, "sound", name)
+		}
+		return
+	}
+
+	upload := &pendingUpload{
+		guildID:   uMsg.GuildID,
+		channelID: uMsg.ChannelID,
+		messageID: uMsg.ID,
+		userID:    uMsg.Author.ID,
+		name:      name,
+		sound:     sound,
+		duplicate: duplicate,
+	}
+
+	var content string
+	var buttons []discordgo.MessageComponent
+	button := func(label string, style discordgo.ButtonStyle, choice string) discordgo.MessageComponent {
+		return discordgo.Button{
+			Label:    label,
+			Style:    style,
+			CustomID: uploadChoicePrefix + " " + choice + " " + attachment.ID,
+		}
+	}
+	switch {
+	case nameTaken && duplicate == name:
+		content = fmt.Sprintf("**%s** is already here with the same file", name)
+	case nameTaken && duplicate != "":
+		content = fmt.Sprintf("There's already a sound called **%s**, and this file is the same as **%s**", name, duplicate)
+	case nameTaken:
+		content = fmt.Sprintf("There's already a sound called **%s**", name)
+	default:
+		content = fmt.Sprintf("This file is the same as **%s**", duplicate)
+	}
+	if nameTaken {
+		buttons = []discordgo.MessageComponent{
+			button("Replace "+name, discordgo.DangerButton, choiceReplace),
+			button("Keep as "+freeSoundName(gState, name), discordgo.PrimaryButton, choiceSuffix),
+			button("Reject", discordgo.SecondaryButton, choiceReject),
+		}
+	} else {
+		buttons = []discordgo.MessageComponent{
+			button("Keep anyway", discordgo.PrimaryButton, choiceKeep),
+			button("Reject", discordgo.SecondaryButton, choiceReject),
+		}
+	}
+
+	prompt, err := d.ChannelMessageSendComplex(uMsg.ChannelID, &discordgo.MessageSend{
+		Content:    content + fmt.Sprintf(", what should happen to this upload? (rejected in %d minutes if nobody picks)", int(uploadChoiceTTL.Minutes())),
+		Components: []discordgo.MessageComponent{discordgo.ActionsRow{Components: buttons}},
+		Reference:  uMsg.Reference(),
+	})
+	if err != nil {
+		logError("asking about duplicate upload", err, "guild", uMsg.GuildID)
+		return
+	}
+	upload.promptID = prompt.ID
+
+	pendingUploads.Lock()
+	pendingUploads.uploads[attachment.ID] = upload
+	upload.timer = time.AfterFunc(uploadChoiceTTL, func() {
+		expireUpload(d, attachment.ID)
+	})
+	pendingUploads.Unlock()
+}
+
+// handleUploadChoice resolves a pending upload with the button the uploader clicked
+func handleUploadChoice(d *discordgo.Session, i *discordgo.InteractionCreate, choice string, attachmentID string) {
+	pendingUploads.Lock()
+	upload, ok := pendingUploads.uploads[attachmentID]
+	if ok && upload.userID == i.Member.User.ID {
+		delete(pendingUploads.uploads, attachmentID)
+		upload.timer.Stop()
+	}
+	pendingUploads.Unlock()
+
+	if !ok || upload.userID != i.Member.User.ID {
+		content := "This upload was already taken care of"
+		if ok {
+			content = "Only whoever uploaded the file can choose"
+		}
+		err := d.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{Content: content, Flags: discordgo.MessageFlagsEphemeral},
+		})
+		if err != nil {
+			logError("answering upload choice", err, "guild", i.GuildID)
+		}
+		return
+	}
+
+	// replacing and renaming re-upload files, that can take longer than an interaction is allowed to wait
+	err := d.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredMessageUpdate,
+	})
+	if err != nil {
+		logError("deferring upload choice", err, "guild", i.GuildID)
+		return
+	}
+
+	content, err := resolveUpload(d, upload, choice)
+	if err != nil {
+		if !expectedError(err) {
+			logError("resolving duplicate upload", err, "guild", upload.guildID, "sound", upload.name, "choice", choice)
+		}
+		content = userMessage(err)
+	}
+
+	components := []discordgo.MessageComponent{}
+	_, err = d.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{Content: &content, Components: &components})
+	if err != nil {
+		logError("answering upload choice", err, "guild", i.GuildID)
+	}
+}
+
+// expireUpload rejects an upload nobody chose for
+func expireUpload(d *discordgo.Session, attachmentID string) {
+	pendingUploads.Lock()
+	upload, ok := pendingUploads.uploads[attachmentID]
+	delete(pendingUploads.uploads, attachmentID)
+	pendingUploads.Unlock()
+	if !ok {
+		return
+	}
+
+	content, err := resolveUpload(d, upload, choiceReject)
+	if err != nil {
+		logError("rejecting expired upload", err, "guild", upload.guildID, "sound", upload.name)
+		return
+	}
+	_, err = d.ChannelMessageEditComplex(&discordgo.MessageEdit{
+		Channel:    upload.channelID,
+		ID:         upload.promptID,
+		Content:    &content,
+		Components: &[]discordgo.MessageComponent{},
+	})
+	if err != nil {
+		logError("updating expired upload prompt", err, "guild", upload.guildID)
+	}
+}
+
+// resolveUpload does what the uploader chose and returns what happened
+func resolveUpload(d *discordgo.Session, upload *pendingUpload, choice string) (string, error) {
+	gState, err := loadedGuild(upload.guildID)
+	if err != nil {
+		return "", err
+	}
+
+	switch choice {
+	case choiceReject:
+		// the other files of a message with several get to stay
+		if len(gState.SoundsInMessage(upload.messageID)) > 0 {
+			return "Rejected", nil
+		}
+		err = d.ChannelMessageDelete(upload.channelID, upload.messageID)
+		if err != nil {
+			return "", failed("Error deleting the upload", err)
+		}
+		return "Rejected, the upload was deleted", nil
+
+	case choiceReplace:
+		old, ok := gState.Sound(upload.name)
+		if !ok {
+			break
+		}
+
+		// the old sound's volume and entrances carry over to the new file
+		restore := exportedSound{Volume: old.Volume}
+		for userID, name := range gState.EntranceNames() {
+			if name == upload.name {
+				restore.Entrances = append(restore.Entrances, userID)
+			}
+		}
+
+		if old.MessageID == upload.messageID {
+			// both files are in the same upload, deleting the message would take the new one with it
+			err = unlistSound(upload.guildID, gState, upload.name, old)
+		} else {
+			err = deleteSound(d, upload.guildID, gState, upload.name)
+		}
+		if err != nil {
+			return "", err
+		}
+		err = addSound(d, upload.guildID, gState, upload.name, upload.sound)
+		if err != nil {
+			return "", err
+		}
+		err = restoreMetadata(d, upload.guildID, gState, upload.name, restore)
+		if err != nil {
+			return "", failed("Replaced "+upload.name+", but its volume/entrances couldn't be kept", err)
+		}
+		return "Replaced " + upload.name, nil
+
+	case choiceSuffix, choiceKeep:
+		if _, taken := gState.Sound(upload.name); !taken {
+			break
+		}
+
+		// the discord store names sounds after their file, so the file has to be re-uploaded with the new name
+		newName := freeSoundName(gState, upload.name)
+		_, sound, err := reuploadSound(d, upload.guildID, upload.sound, upload.name, newName)
+		if err != nil {
+			return "", failed("Error renaming the upload", err)
+		}
+		err = addSound(d, upload.guildID, gState, newName, sound)
+		if err != nil {
+			return "", err
+		}
+		return "Added as " + newName, nil
+
+	default:
+		return "", userErrorf("Unknown choice")
+	}
+
+	// the conflict went away while waiting, the upload goes in as it is
+	err = addSound(d, upload.guildID, gState, upload.name, upload.sound)
+	if err != nil {
+		return "", err
+	}
+	return "Added " + upload.name, nil
+}
+
+// findDuplicate returns the name of a sound with the same content as sound, only sounds of the same size get hashed
+func findDuplicate(d *discordgo.Session, gState *GuildState, sound *Sound) string {
+	if sound.Hash == "" || sound.Size == 0 {
+		return ""
+	}
+
+	for _, name := range gState.SoundNames() {
+		existing, ok := gState.Sound(name)
+		if !ok || existing.Size != sound.Size || existing.fileID() == sound.fileID() {
+			continue
+		}
+		if soundHash(d, gState, existing) == sound.Hash {
+			return name
+		}
+	}
+	return ""
+}
+
+// soundHash returns the sound's hash, downloading the file if it isn't known yet, empty if that fails
+func soundHash(d *discordgo.Session, gState *GuildState, sound *Sound) string {
+	if sound.Hash != "" {
+		return sound.Hash
+	}
+	if hash, ok := soundHashes.Load(sound.fileID()); ok {
+		return hash.(string)
+	}
+
+	hash, err := hashSound(d, gState, sound)
+	if err != nil {
+		logError("hashing sound", err, "message", sound.MessageID)
+		return ""
+	}
+	soundHashes.Store(sound.fileID(), hash)
+	return hash
+}
+
+func hashSound(d *discordgo.Session, gState *GuildState, sound *Sound) (string, error) {
+	resp, err := downloadSound(context.Background(), d, gState, sound)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	return hashReader(io.LimitReader(resp.Body, maxHashSize))
+}
+
+func hashReader(r io.Reader) (string, error) {
+	hash := sha256.New()
+	_, err := io.Copy(hash, r)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
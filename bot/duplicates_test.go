@@ -0,0 +1,34 @@
+package bot
+
+import "testing"
+
+func TestFindDuplicateByFile(t *testing.T) {
+	gState := newTestGuild(t, 0)
+	// two files of one upload with the same content, each one is the other's duplicate
+	a := &Sound{MessageID: "m", URL: "https://cdn.discordapp.com/attachments/c/a1/a.mp3", Size: 10, Hash: "same"}
+	b := &Sound{MessageID: "m", URL: "https://cdn.discordapp.com/attachments/c/a2/b.mp3", Size: 10, Hash: "same"}
+	gState.AddSound("a", a)
+
+	if duplicate := findDuplicate(nil, gState, b); duplicate != "a" {
+		t.Errorf("findDuplicate(b) = %q, want a, it's in the same message but another file", duplicate)
+	}
+	if duplicate := findDuplicate(nil, gState, a); duplicate != "" {
+		t.Errorf("findDuplicate(a) = %q, a isn't a duplicate of itself", duplicate)
+	}
+}
+
+func TestForgetSoundFileDropsItsHash(t *testing.T) {
+	a := &Sound{MessageID: "m", URL: "https://cdn.discordapp.com/attachments/c/a1/a.mp3"}
+	b := &Sound{MessageID: "m", URL: "https://cdn.discordapp.com/attachments/c/a2/b.mp3"}
+	soundHashes.Store(a.fileID(), "hash of a")
+	soundHashes.Store(b.fileID(), "hash of b")
+	t.Cleanup(func() { soundHashes.Delete(b.fileID()) })
+
+	forgetSoundFile(a)
+	if _, ok := soundHashes.Load(a.fileID()); ok {
+		t.Error("a's hash is still cached")
+	}
+	if hash := soundHash(nil, nil, b); hash != "hash of b" {
+		t.Errorf("b's cached hash = %q", hash)
+	}
+}
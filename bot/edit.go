@@ -0,0 +1,369 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// ,trim and ,fade run ffmpeg on the stored file and answer with the result as a preview,
+// the sound only gets the new file (re-uploaded like a rename) once whoever asked applies it.
+// the buttons' custom id is "edit <choice> <editID>"
+const editChoicePrefix = "edit"
+
+const (
+	choiceApply  = "apply"
+	choiceCancel = "cancel"
+)
+
+// editTTL is how long a preview can be applied, the edited file is deleted after that
+const editTTL = 10 * time.Minute
+
+type pendingEdit struct {
+	guildID string
+	userID  string
+	name    string
+	// messageID is the sound's message the edit was made from, a sound that changed since doesn't take it
+	messageID string
+	// description is what was done, "trimmed to 0:01.0-0:03.5"
+	description string
+	// path is the edited file, sound describes it
+	path  string
+	sound *Sound
+	timer *time.Timer
+}
+
+// pendingEdits [editID] are previews waiting to be applied, they're only kept in memory
+var pendingEdits = struct {
+	sync.Mutex
+	edits map[string]*pendingEdit
+}{edits: make(map[string]*pendingEdit)}
+
+// handleTrim keeps only the part of a sound between start and end
+func handleTrim(req *commandRequest) error {
+	start, err := parseTimestamp(req.Args[1])
+	if err != nil {
+		return err
+	}
+	end, err := parseTimestamp(req.Args[2])
+	if err != nil {
+		return err
+	}
+	if end <= start {
+		return userErrorf("The end has to be after the start")
+	}
+
+	name, sound, err := req.lookupSound()
+	if err != nil {
+		return err
+	}
+	sound = freshSound(req.d, req.gState, sound)
+
+	duration, err := probeDuration(context.Background(), sound.URL)
+	if err != nil {
+		return failed("Error reading "+name, err)
+	}
+	if start >= duration {
+		return userErrorf("%s is only %s long", name, formatTimestamp(duration))
+	}
+	// an end past the sound's own length means up to the end
+	end = min(end, duration)
+	if start == 0 && end == duration {
+		return userErrorf("That's all of %s already", name)
+	}
+
+	filter := fmt.Sprintf("atrim=start=%.3f:end=%.3f,asetpts=PTS-STARTPTS", start.Seconds(), end.Seconds())
+	description := fmt.Sprintf("trimmed to %s-%s", formatTimestamp(start), formatTimestamp(end))
+	return previewEdit(req, name, sound, filter, description)
+}
+
+// handleFade fades a sound in from silence or out to silence over the given milliseconds
+func handleFade(req *commandRequest) error {
+	direction := strings.ToLower(req.Args[1])
+	if direction != "in" && direction != "out" {
+		return userErrorf("Fade `in` or `out`")
+	}
+	ms, err := strconv.Atoi(req.Args[2])
+	if err != nil || ms <= 0 {
+		return userErrorf("The fade length is in milliseconds, like 500")
+	}
+	length := time.Duration(ms) * time.Millisecond
+
+	name, sound, err := req.lookupSound()
+	if err != nil {
+		return err
+	}
+	sound = freshSound(req.d, req.gState, sound)
+
+	duration, err := probeDuration(context.Background(), sound.URL)
+	if err != nil {
+		return failed("Error reading "+name, err)
+	}
+	// compared in milliseconds, a huge ms overflows length
+	if int64(ms) > duration.Milliseconds() {
+		return userErrorf("%s is only %s long", name, formatTimestamp(duration))
+	}
+
+	filter := fmt.Sprintf("afade=t=in:d=%.3f", length.Seconds())
+	if direction == "out" {
+		filter = fmt.Sprintf("afade=t=out:st=%.3f:d=%.3f", (duration - length).Seconds(), length.Seconds())
+	}
+	description := fmt.Sprintf("faded %s over %dms", direction, ms)
+	return previewEdit(req, name, sound, filter, description)
+}
+
+// previewEdit runs the sound through filter and answers with the result and buttons to apply or cancel it
+func previewEdit(req *commandRequest, name string, sound *Sound, filter string, description string) error {
+	tmp, err := os.CreateTemp("", "ebening-edit-*."+sound.format())
+	if err != nil {
+		return failed("Error editing "+name, err)
+	}
+	tmp.Close()
+	path := tmp.Name()
+
+	edited, err := editSoundFile(context.Background(), sound, path, filter)
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	edit := &pendingEdit{
+		guildID:     req.GuildID,
+		userID:      req.User.ID,
+		name:        name,
+		messageID:   sound.MessageID,
+		description: description,
+		path:        path,
+		sound:       edited,
+	}
+	editID := addPendingEdit(edit)
+
+	file, err := os.Open(path)
+	if err != nil {
+		dropPendingEdit(editID)
+		return failed("Error editing "+name, err)
+	}
+	defer file.Close()
+
+	buttons := []discordgo.MessageComponent{discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+		discordgo.Button{Label: "Apply", Style: discordgo.SuccessButton, CustomID: editChoicePrefix + " " + choiceApply + " " + editID},
+		discordgo.Button{Label: "Cancel", Style: discordgo.SecondaryButton, CustomID: editChoicePrefix + " " + choiceCancel + " " + editID},
+	}}}
+	content := fmt.Sprintf("**%s** %s, apply it? (the preview expires in %d minutes)", name, description, int(editTTL.Minutes()))
+	err = req.Preview(content, sound.fileName(name), file, buttons)
+	if err != nil {
+		dropPendingEdit(editID)
+		return err
+	}
+	return nil
+}
+
+// editSoundFile writes the sound run through filter to path and checks the result could still be a sound
+func editSoundFile(ctx context.Context, sound *Sound, path string, filter string) (*Sound, error) {
+	var stderr bytes.Buffer
+	ctx, cancel := context.WithTimeout(ctx, analyzeTimeout)
+	defer cancel()
+	edit := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-nostats", "-v", "error", "-y", "-i", sound.URL,
+		"-map", "0:a", "-map_metadata", "0", "-af", filter, path)
+	edit.Stderr = &stderr
+	err := edit.Run()
+	if err != nil {
+		return nil, failed("Error editing the sound", fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String())))
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, failed("Error editing the sound", err)
+	}
+	err = checkSize(int(stat.Size()))
+	if err != nil {
+		return nil, userErrorf("The edited sound can't be used, %s", userMessage(err))
+	}
+	info, err := analyzeAudio(ctx, path)
+	if err != nil {
+		return nil, failed("Error editing the sound", err)
+	}
+	err = checkAudio(info)
+	if err != nil {
+		return nil, userErrorf("The edited sound can't be used, %s", userMessage(err))
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, failed("Error editing the sound", err)
+	}
+	defer file.Close()
+	hash, err := hashReader(file)
+	if err != nil {
+		return nil, failed("Error editing the sound", err)
+	}
+
+	edited := *sound
+	edited.Size = int(stat.Size())
+	edited.Hash = hash
+	edited.Loudness = info.Loudness
+	edited.Peak = info.Peak
+	return &edited, nil
+}
+
+func addPendingEdit(edit *pendingEdit) string {
+	pendingEdits.Lock()
+	defer pendingEdits.Unlock()
+
+	// ids only have to tell apart the edits alive at the same time, and not match a button from before a restart
+	editID := strconv.FormatInt(time.Now().UnixNano(), 36)
+	for _, taken := pendingEdits.edits[editID]; taken; _, taken = pendingEdits.edits[editID] {
+		editID += "0"
+	}
+	pendingEdits.edits[editID] = edit
+	edit.timer = time.AfterFunc(editTTL, func() {
+		dropPendingEdit(editID)
+	})
+	return editID
+}
+
+// dropPendingEdit forgets an edit and deletes its file
+func dropPendingEdit(editID string) {
+	pendingEdits.Lock()
+	edit, ok := pendingEdits.edits[editID]
+	delete(pendingEdits.edits, editID)
+	pendingEdits.Unlock()
+	if !ok {
+		return
+	}
+
+	edit.timer.Stop()
+	os.Remove(edit.path)
+}
+
+// handleEditChoice applies or cancels a preview with the button whoever asked for it clicked
+func handleEditChoice(d *discordgo.Session, i *discordgo.InteractionCreate, choice string, editID string) {
+	pendingEdits.Lock()
+	edit, ok := pendingEdits.edits[editID]
+	if ok && edit.userID == i.Member.User.ID {
+		delete(pendingEdits.edits, editID)
+		edit.timer.Stop()
+	}
+	pendingEdits.Unlock()
+
+	if !ok || edit.userID != i.Member.User.ID {
+		content := "This preview expired, run the command again"
+		if ok {
+			content = "Only whoever asked for the edit can apply it"
+		}
+		err := d.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{Content: content, Flags: discordgo.MessageFlagsEphemeral},
+		})
+		if err != nil {
+			logError("answering edit choice", err, "guild", i.GuildID)
+		}
+		return
+	}
+	defer os.Remove(edit.path)
+
+	// applying re-uploads the file, that can take longer than an interaction is allowed to wait
+	err := d.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredMessageUpdate,
+	})
+	if err != nil {
+		logError("deferring edit choice", err, "guild", i.GuildID)
+		return
+	}
+
+	content, err := resolveEdit(d, edit, choice)
+	if err != nil {
+		if !expectedError(err) {
+			logError("applying edit", err, "guild", edit.guildID, "sound", edit.name)
+		}
+		content = userMessage(err)
+	}
+
+	components := []discordgo.MessageComponent{}
+	_, err = d.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{Content: &content, Components: &components})
+	if err != nil {
+		logError("answering edit choice", err, "guild", i.GuildID)
+	}
+}
+
+// resolveEdit does what was chosen and returns what happened
+func resolveEdit(d *discordgo.Session, edit *pendingEdit, choice string) (string, error) {
+	switch choice {
+	case choiceCancel:
+		return "Cancelled, **" + edit.name + "** wasn't changed", nil
+	case choiceApply:
+	default:
+		return "", userErrorf("Unknown choice")
+	}
+
+	gState, err := loadedGuild(edit.guildID)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.Open(edit.path)
+	if err != nil {
+		return "", failed("Error applying the edit", err)
+	}
+	defer file.Close()
+
+	_, err = replaceSoundFile(d, edit.guildID, gState, edit.name, edit.messageID, edit.sound, file)
+	if errors.Is(err, errSoundNotFound) {
+		return "", userErrorf("**%s** was changed or deleted since the preview, run the command again", edit.name)
+	}
+	if err != nil {
+		return "", err
+	}
+	return "**" + edit.name + "** " + edit.description, nil
+}
+
+// parseTimestamp reads "1.5", "1:02.5" (minutes:seconds) or a duration like "1500ms",
+// whether it's past the end of the sound is up to the caller (sounds from before MaxSoundDuration can be longer)
+func parseTimestamp(s string) (time.Duration, error) {
+	invalid := userErrorf("%q isn't a time, use seconds (1.5), minutes:seconds (1:02.5) or 1500ms", s)
+	if strings.ContainsAny(s, "hmsuµn") {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return 0, invalid
+		}
+		return d, nil
+	}
+
+	minutes, seconds, hasMinutes := strings.Cut(s, ":")
+	if !hasMinutes {
+		minutes, seconds = "0", s
+	}
+	m, err := strconv.Atoi(minutes)
+	if err != nil || m < 0 {
+		return 0, invalid
+	}
+	sec, err := strconv.ParseFloat(seconds, 64)
+	// ParseFloat takes "inf" and "nan" too
+	if err != nil || math.IsInf(sec, 0) || math.IsNaN(sec) || sec < 0 || (hasMinutes && sec >= 60) {
+		return 0, invalid
+	}
+	// checked as seconds first, a huge number doesn't fit in a time.Duration
+	if float64(m)*60+sec > maxTimestamp.Seconds() {
+		return 0, userErrorf("%s is longer than any sound", s)
+	}
+	return time.Duration(m)*time.Minute + time.Duration(sec*float64(time.Second)), nil
+}
+
+// maxTimestamp is the longest time.Duration
+const maxTimestamp = time.Duration(math.MaxInt64)
+
+// formatTimestamp writes d as minutes:seconds, 62.5s is "1:02.5"
+func formatTimestamp(d time.Duration) string {
+	d = d.Round(100 * time.Millisecond)
+	return fmt.Sprintf("%d:%04.1f", int(d/time.Minute), (d % time.Minute).Seconds())
+}
@@ -0,0 +1,32 @@
+package bot
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	valid := map[string]time.Duration{
+		"1.5":    1500 * time.Millisecond,
+		"0:42.5": 42500 * time.Millisecond,
+		"1500ms": 1500 * time.Millisecond,
+		"0":      0,
+		"60":     time.Minute,
+		// longer than new uploads can be, older sounds can still be
+		"2:30": 150 * time.Second,
+		"600":  10 * time.Minute,
+		"1h":   time.Hour,
+	}
+	for s, want := range valid {
+		got, err := parseTimestamp(s)
+		if err != nil || got != want {
+			t.Errorf("parseTimestamp(%q) = %s, %v, want %s", s, got, err, want)
+		}
+	}
+
+	for _, s := range []string{"", "foo", "-1", "1:60", "inf", "+Inf", "NaN", "1e300", "1e400", "9223372036854775807:00", "153722867280912931:00", "-1:00", "-1s"} {
+		if got, err := parseTimestamp(s); err == nil {
+			t.Errorf("parseTimestamp(%q) = %s, want an error", s, got)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var (
+	errGuildNotLoaded  = errors.New("guild not loaded")
+	errSoundNotFound   = errors.New("sound not found")
+	errSoundExists     = errors.New("a sound with that name already exists")
+	errNoSoundsChannel = errors.New("no sounds channel found")
+	errAlreadyEntrance = errors.New("sound is already the user's entrance")
+	// errAnswered means the handler already told the user why it stopped (e.g. with "did you mean" buttons)
+	errAnswered = errors.New("already answered")
+)
+
+// userError is an error whose message is shown to the user as is, the cause (if any) only goes to the logs
+type userError struct {
+	msg   string
+	cause error
+}
+
+func (e *userError) Error() string {
+	if e.cause == nil {
+		return e.msg
+	}
+	return e.msg + ": " + e.cause.Error()
+}
+
+func (e *userError) Unwrap() error {
+	return e.cause
+}
+
+// userErrorf is for commands that can't do what was asked, nothing actually went wrong
+func userErrorf(format string, a ...any) error {
+	return &userError{msg: fmt.Sprintf(format, a...)}
+}
+
+// failed tells the user msg and logs cause
+func failed(msg string, cause error) error {
+	return &userError{msg: msg, cause: cause}
+}
+
+// panicError is a recovered panic, stack is where it happened
+type panicError struct {
+	value any
+	stack []byte
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.value)
+}
+
+// userMessage is what the user gets to see for err
+func userMessage(err error) string {
+	var uErr *userError
+	switch {
+	case errors.As(err, &uErr):
+		return uErr.msg
+	case errors.Is(err, errGuildNotLoaded):
+		return "Sounds are still loading, try again in a bit"
+	case errors.Is(err, errSoundNotFound):
+		return "Sound not found"
+	case errors.Is(err, errSoundExists):
+		return "There's already a sound with that name"
+	case errors.Is(err, errAlreadyEntrance):
+		return "This is already your entrance"
+	case errors.Is(err, errUnauthorized):
+		return "You need to log in"
+	case errors.Is(err, errForbidden):
+		return "You don't have access to this guild"
+	default:
+		return "Something went wrong, try again in a bit"
+	}
+}
+
+// expectedError is true for errors that are the user's doing rather than the bot's, they aren't logged
+func expectedError(err error) bool {
+	var uErr *userError
+	if errors.As(err, &uErr) && uErr.cause == nil {
+		return true
+	}
+	return errors.Is(err, errGuildNotLoaded) || errors.Is(err, errSoundNotFound) ||
+		errors.Is(err, errSoundExists) || errors.Is(err, errAlreadyEntrance) ||
+		errors.Is(err, errUnauthorized) || errors.Is(err, errForbidden)
+}
+
+// logError logs err, with the stack trace if it was a panic
+func logError(msg string, err error, attrs ...any) {
+	var pErr *panicError
+	if errors.As(err, &pErr) {
+		attrs = append(attrs, "stack", string(pErr.stack))
+	}
+	slog.Error(msg, append(attrs, "err", err)...)
+}
+
+// callRecovered runs fn and turns a panic into a *panicError
+func callRecovered(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &panicError{value: r, stack: debug.Stack()}
+		}
+	}()
+	return fn()
+}
+
+// recovered wraps a gateway event handler so a panic in it gets logged instead of taking the whole bot down
+func recovered[E any](name string, handler func(*discordgo.Session, E)) func(*discordgo.Session, E) {
+	return func(d *discordgo.Session, event E) {
+		err := callRecovered(func() error {
+			handler(d, event)
+			return nil
+		})
+		if err != nil {
+			logError("handler panicked", err, "handler", name)
+		}
+	}
+}
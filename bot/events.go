@@ -0,0 +1,184 @@
+package bot
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Event is something that changed in a guild, GuildState and PlaybackQueue publish them as they change
+type Event struct {
+	Type    string `json:"type"`
+	GuildID string `json:"guildId"`
+	Data    any    `json:"data,omitempty"`
+}
+
+const (
+	EventVoiceJoin      = "voice.join"
+	EventVoiceLeave     = "voice.leave"
+	EventPlaybackStart  = "playback.start"
+	EventPlaybackStop   = "playback.stop"
+	EventPlaybackStatus = "playback.status"
+	EventQueueUpdate    = "queue.update"
+	EventSoundAdd       = "sound.add"
+	EventSoundRename    = "sound.rename"
+	EventSoundUpdate    = "sound.update"
+	EventSoundDelete    = "sound.delete"
+	EventSoundsReload   = "sounds.reload"
+	EventEntranceUpdate = "entrance.update"
+	EventSettingsUpdate = "settings.update"
+)
+
+type soundEvent struct {
+	Name    string `json:"name"`
+	NewName string `json:"newName,omitempty"`
+	Sound   *Sound `json:"sound,omitempty"`
+}
+
+type voiceEvent struct {
+	UserID    string `json:"userId"`
+	Username  string `json:"username,omitempty"`
+	ChannelID string `json:"channelId"`
+}
+
+type queueEvent struct {
+	NowPlaying *QueueItem   `json:"nowPlaying"`
+	Queue      []*QueueItem `json:"queue"`
+}
+
+type playbackEvent struct {
+	*QueueItem
+	Error string `json:"error,omitempty"`
+}
+
+type entranceEvent struct {
+	UserID string `json:"userId"`
+	Name   string `json:"name"`
+}
+
+// subscriberBuffer is how far a subscriber can fall behind before it gets dropped,
+// a dropped stream ends and the client reconnects (and gets a fresh snapshot)
+const subscriberBuffer = 64
+
+// eventHub fans a guild's events out to everyone subscribed to it, Publish never blocks
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan Event]struct{}
+}
+
+var events = newEventHub()
+
+func newEventHub() *eventHub {
+	return &eventHub{subscribers: make(map[string]map[chan Event]struct{})}
+}
+
+// Subscribe returns a channel with the guild's events, it's closed by unsubscribe or when the subscriber falls behind
+func (h *eventHub) Subscribe(guildID string) (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+
+	h.mu.Lock()
+	if h.subscribers[guildID] == nil {
+		h.subscribers[guildID] = make(map[chan Event]struct{})
+	}
+	h.subscribers[guildID][ch] = struct{}{}
+	h.mu.Unlock()
+
+	unsubscribe := func() {
+		h.mu.Lock()
+		h.remove(guildID, ch)
+		h.mu.Unlock()
+	}
+	return ch, unsubscribe
+}
+
+func (h *eventHub) Publish(guildID string, eventType string, data any) {
+	event := Event{Type: eventType, GuildID: guildID, Data: data}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subscribers[guildID] {
+		select {
+		case ch <- event:
+		default:
+			h.remove(guildID, ch)
+		}
+	}
+}
+
+func (h *eventHub) remove(guildID string, ch chan Event) {
+	if _, ok := h.subscribers[guildID][ch]; !ok {
+		return
+	}
+	delete(h.subscribers[guildID], ch)
+	close(ch)
+	if len(h.subscribers[guildID]) == 0 {
+		delete(h.subscribers, guildID)
+	}
+}
+
+// streamEvents is a server-sent events stream of the guild, it starts with a "state" event holding the whole GuildState
+func (a *api) streamEvents(w http.ResponseWriter, r *http.Request) {
+	guildID := r.PathValue("id")
+	gState, err := loadedGuild(guildID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, fmt.Errorf("streaming not supported"))
+		return
+	}
+
+	// subscribe before the snapshot so nothing that happens in between is missed
+	ch, unsubscribe := events.Subscribe(guildID)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	err = writeEvent(w, Event{Type: "state", GuildID: guildID, Data: gState})
+	if err != nil {
+		return
+	}
+	flusher.Flush()
+
+	// proxies drop connections that stay quiet for too long
+	heartbeat := time.NewTicker(30 * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+			err = writeEvent(w, event)
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": ping\n\n")
+		case <-r.Context().Done():
+			return
+		case <-shuttingDown:
+			return
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+	return err
+}
@@ -0,0 +1,221 @@
+package bot
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/cgoncalveslck/go-api-ebening/bot/metadata"
+)
+
+// manifestName is where an export keeps its manifest, the zip importer looks for it to restore metadata
+const manifestName = "manifest.json"
+
+// manifestVersion 2 has volumes in percent, version 1 had them in dca's scale
+const manifestVersion = 2
+
+// exportManifest is everything about a guild's sounds besides the files themselves
+type exportManifest struct {
+	Version    int             `json:"version"`
+	GuildID    string          `json:"guildId"`
+	ExportedAt time.Time       `json:"exportedAt"`
+	Sounds     []exportedSound `json:"sounds"`
+	// Missing are sounds whose file couldn't be downloaded, they're not in the zip
+	Missing []string `json:"missing,omitempty"`
+}
+
+type exportedSound struct {
+	Name string `json:"name"`
+	// File is the sound's path in the zip
+	File      string   `json:"file"`
+	Format    string   `json:"format"`
+	Volume    *int     `json:"volume,omitempty"`
+	MessageID string   `json:"messageId"`
+	Entrances []string `json:"entrances,omitempty"`
+}
+
+// exportSounds streams every sound of the guild into a zip written to w, with the manifest at the end
+// a sound that can't be downloaded is listed as missing instead of failing the whole export
+func exportSounds(ctx context.Context, d *discordgo.Session, w io.Writer, guildID string, gState *GuildState) (exportManifest, error) {
+	manifest := exportManifest{
+		Version:    manifestVersion,
+		GuildID:    guildID,
+		ExportedAt: time.Now().UTC(),
+		Sounds:     []exportedSound{},
+	}
+
+	entrances := make(map[string][]string)
+	for userID, name := range gState.EntranceNames() {
+		entrances[name] = append(entrances[name], userID)
+	}
+	for _, userIDs := range entrances {
+		slices.Sort(userIDs)
+	}
+
+	archive := zip.NewWriter(w)
+	sList := gState.Sounds()
+	for _, name := range gState.SoundNames() {
+		sound, ok := sList[name]
+		if !ok {
+			continue
+		}
+
+		file := "sounds/" + sound.fileName(name)
+		err := exportSound(ctx, d, gState, archive, file, sound)
+		if err != nil {
+			if ctx.Err() != nil {
+				return manifest, ctx.Err()
+			}
+			slog.Warn("leaving sound out of export", "guild", guildID, "sound", name, "err", err)
+			manifest.Missing = append(manifest.Missing, name)
+			continue
+		}
+
+		manifest.Sounds = append(manifest.Sounds, exportedSound{
+			Name:      name,
+			File:      file,
+			Format:    sound.format(),
+			Volume:    sound.Volume,
+			MessageID: sound.MessageID,
+			Entrances: entrances[name],
+		})
+	}
+
+	manifestWriter, err := archive.Create(manifestName)
+	if err != nil {
+		return manifest, err
+	}
+	encoder := json.NewEncoder(manifestWriter)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(manifest)
+	if err != nil {
+		return manifest, err
+	}
+	return manifest, archive.Close()
+}
+
+// exportSound adds the sound to the zip, audio is already compressed so it's only stored
+// the whole file is downloaded before its entry is created, a download that fails partway leaves nothing in the zip
+func exportSound(ctx context.Context, d *discordgo.Session, gState *GuildState, archive *zip.Writer, file string, sound *Sound) error {
+	resp, err := downloadSound(ctx, d, gState, sound)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("downloading sound: %w", err)
+	}
+
+	entry, err := archive.CreateHeader(&zip.FileHeader{
+		Name:     file,
+		Method:   zip.Store,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = entry.Write(data)
+	return err
+}
+
+// readManifest returns the export manifest in the zip, [File] -> sound, nil if there's none
+func readManifest(archive *zip.Reader) (map[string]exportedSound, error) {
+	for _, file := range archive.File {
+		if file.Name != manifestName {
+			continue
+		}
+
+		reader, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+
+		var manifest exportManifest
+		err = json.NewDecoder(io.LimitReader(reader, 1<<20)).Decode(&manifest)
+		if err != nil {
+			return nil, err
+		}
+
+		sounds := make(map[string]exportedSound, len(manifest.Sounds))
+		for _, sound := range manifest.Sounds {
+			if manifest.Version < 2 && sound.Volume != nil {
+				sound.Volume = metadata.PercentFromDCA(*sound.Volume)
+			}
+			sounds[sound.File] = sound
+		}
+		return sounds, nil
+	}
+	return nil, nil
+}
+
+// handleExport uploads the export to the channel, guilds with too many sounds for one upload have to use the HTTP API
+func handleExport(req *commandRequest) error {
+	if req.gState.SoundCount() == 0 {
+		return userErrorf("No sounds loaded")
+	}
+
+	tmp, err := os.CreateTemp("", "ebening-export-*.zip")
+	if err != nil {
+		return failed("Error exporting sounds", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	manifest, err := exportSounds(context.Background(), req.d, tmp, req.GuildID, req.gState)
+	if err != nil {
+		return failed("Error exporting sounds", err)
+	}
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return failed("Error exporting sounds", err)
+	}
+	if size > uploadLimit {
+		return userErrorf("The export is %d MB, that's too big to upload here. Download it with `GET /api/v1/guilds/%s/export` instead", size>>20, req.GuildID)
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return failed("Error exporting sounds", err)
+	}
+
+	content := fmt.Sprintf("Exported %d sounds", len(manifest.Sounds))
+	if len(manifest.Missing) > 0 {
+		content += fmt.Sprintf(", %d couldn't be downloaded", len(manifest.Missing))
+	}
+	return req.SendFile(content, exportFileName(req.GuildID), tmp)
+}
+
+func exportFileName(guildID string) string {
+	return "sounds-" + guildID + "-" + time.Now().UTC().Format("20060102") + ".zip"
+}
+
+// export streams the guild's sounds as a zip, see exportSounds
+func (a *api) export(w http.ResponseWriter, r *http.Request) {
+	guildID := r.PathValue("id")
+	gState, err := loadedGuild(guildID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+exportFileName(guildID)+`"`)
+	w.WriteHeader(http.StatusOK)
+
+	// the status is already out, a failure now can only cut the download short
+	_, err = exportSounds(r.Context(), a.d, w, guildID, gState)
+	if err != nil && r.Context().Err() == nil {
+		logError("exporting sounds", err, "guild", guildID)
+	}
+}
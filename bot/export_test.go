@@ -0,0 +1,158 @@
+package bot
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// exportServer serves sound files like the CDN, /broken.mp3 cuts its body off partway through
+func exportServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken.mp3" {
+			w.Header().Set("Content-Length", "1000")
+			w.Write([]byte("only part of it"))
+			return
+		}
+		w.Write([]byte("audio of " + r.URL.Path))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func readZipFile(t *testing.T, archive *zip.Reader, name string) []byte {
+	t.Helper()
+
+	reader, err := archive.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	srv := exportServer(t)
+	exported := newTestGuild(t, 0)
+	volume := 40
+	airhorn := &Sound{MessageID: "m1", URL: srv.URL + "/airhorn.ogg", Format: "ogg", Volume: &volume}
+	exported.AddSound("airhorn", airhorn)
+	exported.AddSound("broken", &Sound{MessageID: "m2", URL: srv.URL + "/broken.mp3"})
+	exported.SetEntrance("user1", airhorn)
+	exported.SetEntrance("user2", airhorn)
+
+	var buf bytes.Buffer
+	manifest, err := exportSounds(context.Background(), nil, &buf, testGuildID, exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(manifest.Missing, []string{"broken"}) {
+		t.Errorf("missing = %v, want [broken]", manifest.Missing)
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range archive.File {
+		names = append(names, file.Name)
+	}
+	// a download that failed partway doesn't leave a truncated file behind
+	if !slices.Equal(names, []string{"sounds/airhorn.ogg", manifestName}) {
+		t.Fatalf("zip has %v, want the airhorn and the manifest", names)
+	}
+	if got := readZipFile(t, archive, "sounds/airhorn.ogg"); string(got) != "audio of /airhorn.ogg" {
+		t.Errorf("airhorn.ogg = %q", got)
+	}
+
+	sounds, err := readManifest(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore, ok := sounds["sounds/airhorn.ogg"]
+	if !ok || len(sounds) != 1 {
+		t.Fatalf("manifest has %v, want the airhorn", sounds)
+	}
+	if restore.Name != "airhorn" || restore.Format != "ogg" || restore.MessageID != "m1" || restore.Volume == nil || *restore.Volume != volume {
+		t.Errorf("manifest airhorn = %+v", restore)
+	}
+
+	imported := newTestGuild(t, 0)
+	imported.AddSound("airhorn", &Sound{MessageID: "m3", Format: "ogg"})
+	kept := &Sound{MessageID: "m4"}
+	imported.AddSound("kept", kept)
+	imported.SetEntrance("user2", kept)
+	newTestBackend(t, imported)
+
+	if err := restoreMetadata(nil, testGuildID, imported, "airhorn", restore); err != nil {
+		t.Fatal(err)
+	}
+	sound, _ := imported.Sound("airhorn")
+	if sound.Volume == nil || *sound.Volume != volume {
+		t.Errorf("restored volume = %v, want %d", sound.Volume, volume)
+	}
+	entrances := imported.EntranceNames()
+	if entrances["user1"] != "airhorn" || entrances["user2"] != "kept" {
+		t.Errorf("restored entrances = %v, want user1 on airhorn and user2 keeping theirs", entrances)
+	}
+}
+
+func TestReadManifestVersion1(t *testing.T) {
+	volume := func(v int) *int { return &v }
+	manifest := exportManifest{
+		Version: 1,
+		Sounds: []exportedSound{
+			{Name: "loud", File: "sounds/loud.mp3", Volume: volume(512)},
+			{Name: "original", File: "sounds/original.mp3", Volume: volume(256)},
+			{Name: "unset", File: "sounds/unset.mp3", Volume: volume(0)},
+			{Name: "none", File: "sounds/none.mp3"},
+		},
+	}
+	archive := testZip(t, func(zw *zip.Writer) {
+		w, err := zw.Create(manifestName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.NewEncoder(w).Encode(manifest); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	sounds, err := readManifest(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]*int{"loud": volume(200), "original": volume(100), "unset": nil, "none": nil}
+	for _, sound := range sounds {
+		got, wanted := sound.Volume, want[sound.Name]
+		if (got == nil) != (wanted == nil) || got != nil && *got != *wanted {
+			t.Errorf("%s volume = %v, want %v", sound.Name, got, wanted)
+		}
+	}
+	if len(sounds) != len(want) {
+		t.Errorf("manifest has %d sounds, want %d", len(sounds), len(want))
+	}
+}
+
+func TestReadManifestMissing(t *testing.T) {
+	archive := testZip(t, func(zw *zip.Writer) {
+		writeZipFile(t, zw, "sounds/a.mp3", zip.Store, []byte("a"))
+	})
+	sounds, err := readManifest(archive)
+	if sounds != nil || err != nil {
+		t.Errorf("readManifest without a manifest = %v, %v", sounds, err)
+	}
+}
@@ -0,0 +1,68 @@
+package bot
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// knownFormats are the extensions ffmpeg (through dca.EncodeFile) is trusted to decode, config.AllowedFormats picks from these
+var knownFormats = []string{"mp3", "ogg", "opus", "wav", "flac", "m4a", "webm"}
+
+// defaultFormat is assumed for sounds saved before the format was tracked, they were all mp3
+const defaultFormat = "mp3"
+
+// splitFileName splits "my.sound.MP3" into "my.sound" and "mp3", only the last dot counts
+// format is empty if the file has no extension
+func splitFileName(fileName string) (string, string) {
+	fileName = filepath.Base(fileName)
+	ext := filepath.Ext(fileName)
+	if ext == "" || ext == fileName {
+		return fileName, ""
+	}
+	return strings.TrimSuffix(fileName, ext), strings.ToLower(ext[1:])
+}
+
+// soundFile returns the sound name and format of an uploaded file, false if it isn't in an allowed format
+func soundFile(fileName string) (string, string, bool) {
+	name, format := splitFileName(fileName)
+	if name == "" || !allowedFormat(format) {
+		return "", "", false
+	}
+	return name, format, true
+}
+
+// storedSoundFile is soundFile for files already in the sounds channel, AllowedFormats only limits new uploads
+// so taking a format off the list doesn't make the sounds already saved in it disappear
+func storedSoundFile(fileName string) (string, string, bool) {
+	name, format := splitFileName(fileName)
+	if name == "" || !slices.Contains(knownFormats, format) {
+		return "", "", false
+	}
+	return name, format, true
+}
+
+func allowedFormat(format string) bool {
+	return format != "" && slices.Contains(config.AllowedFormats, format)
+}
+
+func unsupportedFormatMessage(fileName string) string {
+	return fileName + " isn't a supported format, use one of: " + strings.Join(config.AllowedFormats, ", ")
+}
+
+func isZip(fileName string) bool {
+	_, format := splitFileName(fileName)
+	return format == "zip"
+}
+
+// fileName is what the sound's file is called when it's (re)uploaded
+func (s *Sound) fileName(name string) string {
+	return name + "." + s.format()
+}
+
+func (s *Sound) format() string {
+	if s.Format == "" {
+		return defaultFormat
+	}
+	return s.Format
+}
@@ -0,0 +1,434 @@
+package bot
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	dca "github.com/cgoncalveslck/dcalck"
+)
+
+// sounds play from Opus frames encoded ahead of time when they can, so a popular sound isn't downloaded and run
+// through ffmpeg on every play. The frames are kept on disk as raw DCA (every frame prefixed with its int16 length,
+// what dca.NewDecoder reads) in "<fileID>-<key>.dca" files (see Sound.fileID), the key hashes everything else that changes the
+// encoding (the volume filter, loudness gain included, and the bitrate) so a new volume is a new file and the old one
+// ages out of the LRU. Only a new file (or none) for the sound invalidates its entries
+
+const (
+	frameCacheExt = ".dca"
+	// frameCacheWarmers is how many sounds get encoded ahead of time at once, a zip import shouldn't start hundreds of ffmpegs
+	frameCacheWarmers = 2
+)
+
+// frames is nil when the cache is turned off (config.CacheSizeMB is 0), its methods do nothing then
+var frames *frameCache
+
+type frameCache struct {
+	dir     string
+	maxSize int64
+
+	mu   sync.Mutex
+	size int64
+	// entries [file name] are elements of lru, the front is the most recently used
+	entries map[string]*list.Element
+	lru     *list.List
+
+	// warming [file name] are encodings running in the background, see warm
+	warming sync.Map
+	warmers chan struct{}
+}
+
+type frameCacheEntry struct {
+	name   string
+	fileID string
+	size   int64
+}
+
+// openFrameCache picks up the frames a previous run left in dir, the least recently played are evicted first
+func openFrameCache(dir string, maxSize int64) (*frameCache, error) {
+	if maxSize <= 0 {
+		return nil, nil
+	}
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &frameCache{
+		dir:     dir,
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		warmers: make(chan struct{}, frameCacheWarmers),
+	}
+
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type cachedFile struct {
+		entry   *frameCacheEntry
+		modTime time.Time
+	}
+	var files []cachedFile
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		info, err := dirEntry.Info()
+		if err != nil || !dirEntry.Type().IsRegular() {
+			continue
+		}
+		fileID, _, ok := strings.Cut(name, "-")
+		if !ok || !strings.HasSuffix(name, frameCacheExt) {
+			// a recording that was cut short by a restart
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		files = append(files, cachedFile{&frameCacheEntry{name: name, fileID: fileID, size: info.Size()}, info.ModTime()})
+	}
+
+	// a file's modification time is when it was last played (see open)
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, file := range files {
+		c.entries[file.entry.name] = c.lru.PushFront(file.entry)
+		c.size += file.entry.size
+	}
+	c.evict()
+	slog.Info("opened frame cache", "dir", dir, "files", c.lru.Len(), "mb", c.size>>20)
+	return c, nil
+}
+
+// frameCacheName is the file a sound played through filter is cached in
+func frameCacheName(sound *Sound, filter string) string {
+	hash := sha256.Sum256([]byte(filter + "|" + strconv.Itoa(config.Bitrate)))
+	return sound.fileID() + "-" + hex.EncodeToString(hash[:8]) + frameCacheExt
+}
+
+// open returns the cached frames in name, nil if there are none
+func (c *frameCache) open(name string) *os.File {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	element, ok := c.entries[name]
+	if ok {
+		c.lru.MoveToFront(element)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	path := filepath.Join(c.dir, name)
+	file, err := os.Open(path)
+	if err != nil {
+		logError("opening cached frames", err, "file", name)
+		c.remove(name)
+		return nil
+	}
+	// so the order survives a restart
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return file
+}
+
+// create starts writing frames that become name once they're committed
+func (c *frameCache) create(name string) (*frameWriter, error) {
+	file, err := os.CreateTemp(c.dir, name+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &frameWriter{cache: c, name: name, file: file, buf: bufio.NewWriter(file)}, nil
+}
+
+func (c *frameCache) add(name string, fileID string, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[name]; ok {
+		c.size -= element.Value.(*frameCacheEntry).size
+		c.lru.Remove(element)
+	}
+	c.entries[name] = c.lru.PushFront(&frameCacheEntry{name: name, fileID: fileID, size: size})
+	c.size += size
+	c.evict()
+}
+
+func (c *frameCache) remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[name]; ok {
+		c.removeElement(element)
+	}
+}
+
+// invalidate drops every cached encoding of the file fileID, for when the file is gone
+func (c *frameCache) invalidate(fileID string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, element := range c.entries {
+		if element.Value.(*frameCacheEntry).fileID == fileID {
+			c.removeElement(element)
+		}
+	}
+}
+
+// evict drops the least recently played files until the cache fits, c.mu has to be held
+func (c *frameCache) evict() {
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// removeElement forgets a file and deletes it, a sound playing from it keeps its open file until it's done
+func (c *frameCache) removeElement(element *list.Element) {
+	entry := element.Value.(*frameCacheEntry)
+	c.lru.Remove(element)
+	delete(c.entries, entry.name)
+	c.size -= entry.size
+
+	err := os.Remove(filepath.Join(c.dir, entry.name))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		logError("deleting cached frames", err, "file", entry.name)
+	}
+}
+
+// warm encodes the sound the way gState plays it by default in the background, so even its first play is cached
+func (c *frameCache) warm(d *discordgo.Session, gState *GuildState, sound *Sound) {
+	if c == nil {
+		return
+	}
+
+	filter := sound.volumeFilter(gState.Settings().volumeScale(""))
+	name := frameCacheName(sound, filter)
+	c.mu.Lock()
+	_, cached := c.entries[name]
+	c.mu.Unlock()
+	if cached {
+		return
+	}
+	if _, running := c.warming.LoadOrStore(name, struct{}{}); running {
+		return
+	}
+
+	go func() {
+		defer c.warming.Delete(name)
+		c.warmers <- struct{}{}
+		defer func() { <-c.warmers }()
+
+		err := callRecovered(func() error {
+			encoding, err := startEncoding(d, gState, sound, filter, name)
+			if err != nil {
+				return err
+			}
+			defer encoding.close()
+
+			for {
+				_, err := encoding.OpusFrame()
+				if err == io.EOF {
+					return encoding.session.Error()
+				}
+				if err != nil {
+					return err
+				}
+			}
+		})
+		if err != nil {
+			logError("warming frame cache", err, "message", sound.MessageID)
+		}
+	}()
+}
+
+// record saves the session's frames into name as they're read, they're only kept if the session gets to the end.
+// a sound still plays when its frames can't be cached
+func (c *frameCache) record(name string, fileID string, session *dca.EncodeSession) *frameRecording {
+	if c == nil {
+		return &frameRecording{session: session}
+	}
+	writer, err := c.create(name)
+	if err != nil {
+		logError("caching frames", err, "file", name)
+		return &frameRecording{session: session}
+	}
+	return &frameRecording{session: session, writer: writer, fileID: fileID}
+}
+
+// frameRecording passes the session's frames through while writing them to the cache
+type frameRecording struct {
+	session *dca.EncodeSession
+	writer  *frameWriter
+	fileID  string
+	frames  int
+}
+
+func (r *frameRecording) OpusFrame() ([]byte, error) {
+	frame, err := r.session.OpusFrame()
+	if r.writer == nil {
+		return frame, err
+	}
+
+	switch {
+	case err == io.EOF && r.session.Error() == nil && r.frames > 0:
+		if commitErr := r.writer.commit(r.fileID); commitErr != nil {
+			logError("caching frames", commitErr, "file", r.writer.name)
+		}
+		r.writer = nil
+	case err != nil:
+		r.close()
+	default:
+		if writeErr := r.writer.writeFrame(frame); writeErr != nil {
+			logError("caching frames", writeErr, "file", r.writer.name)
+			r.close()
+		} else {
+			r.frames++
+		}
+	}
+	return frame, err
+}
+
+func (r *frameRecording) FrameDuration() time.Duration {
+	return r.session.FrameDuration()
+}
+
+// close throws away a recording that didn't get to the end (the sound was skipped, or ffmpeg failed)
+func (r *frameRecording) close() {
+	if r.writer != nil {
+		r.writer.discard()
+		r.writer = nil
+	}
+}
+
+type frameWriter struct {
+	cache *frameCache
+	name  string
+	file  *os.File
+	buf   *bufio.Writer
+	size  int64
+}
+
+func (w *frameWriter) writeFrame(frame []byte) error {
+	err := binary.Write(w.buf, binary.LittleEndian, int16(len(frame)))
+	if err != nil {
+		return err
+	}
+	_, err = w.buf.Write(frame)
+	w.size += int64(2 + len(frame))
+	return err
+}
+
+func (w *frameWriter) commit(fileID string) error {
+	err := w.buf.Flush()
+	closeErr := w.file.Close()
+	if err = errors.Join(err, closeErr); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+
+	err = os.Rename(w.file.Name(), filepath.Join(w.cache.dir, w.name))
+	if err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	w.cache.add(w.name, fileID, w.size)
+	return nil
+}
+
+func (w *frameWriter) discard() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// encoding is a sound going through ffmpeg (and into the cache as name), its first frame was already read
+type encoding struct {
+	session   *dca.EncodeSession
+	recording *frameRecording
+	first     []byte
+}
+
+// startEncoding encodes the sound and reads the first frame, so a URL the CDN refused is found (and refreshed, see
+// withFreshURL) before anything plays. gState can be nil, the URL isn't swapped into the guild's sounds then
+func startEncoding(d *discordgo.Session, gState *GuildState, sound *Sound, filter string, cacheName string) (*encoding, error) {
+	var started *encoding
+	_, err := withFreshURL(d, gState, sound, func(sound *Sound) error {
+		session, err := encodeSound(sound, filter)
+		if err != nil {
+			return err
+		}
+		recording := frames.record(cacheName, sound.fileID(), session)
+
+		first, err := recording.OpusFrame()
+		if err == io.EOF {
+			err = session.Error()
+			if err == nil {
+				err = errors.New("no audio")
+			}
+		}
+		if err != nil {
+			recording.close()
+			session.Cleanup()
+			if refusedOutput(session.FFMPEGMessages()) {
+				return fmt.Errorf("%w: %w", errURLRefused, err)
+			}
+			return fmt.Errorf("%w (ffmpeg: %s)", err, session.FFMPEGMessages())
+		}
+
+		started = &encoding{session: session, recording: recording, first: first}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return started, nil
+}
+
+func (e *encoding) OpusFrame() ([]byte, error) {
+	if first := e.first; first != nil {
+		e.first = nil
+		return first, nil
+	}
+	return e.recording.OpusFrame()
+}
+
+func (e *encoding) FrameDuration() time.Duration {
+	return e.session.FrameDuration()
+}
+
+// close stops ffmpeg, frames that weren't all read aren't cached
+func (e *encoding) close() {
+	e.recording.close()
+	e.session.Cleanup()
+}
+
+// encodeSound starts ffmpeg on the sound's file with filter as the volume
+func encodeSound(sound *Sound, filter string) (*dca.EncodeSession, error) {
+	// StdEncodeOptions is a shared pointer, every encoding gets its own copy
+	opts := *dca.StdEncodeOptions
+	opts.RawOutput = true
+	opts.Bitrate = config.Bitrate
+	opts.CompressionLevel = 5
+	// the filter does all the volumes and the sound's loudness gain, dca's own volume stays at 256 (unchanged)
+	opts.AudioFilter = filter
+
+	return dca.EncodeFile(sound.URL, &opts)
+}
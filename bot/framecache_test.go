@@ -0,0 +1,42 @@
+package bot
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFrameCacheKeepsFilesOfOneMessageApart(t *testing.T) {
+	c, err := openFrameCache(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an upload of two files, both unmeasured and played at the same volume
+	a := &Sound{MessageID: "m", URL: "https://cdn.discordapp.com/attachments/c/a1/a.mp3"}
+	b := &Sound{MessageID: "m", URL: "https://cdn.discordapp.com/attachments/c/a2/b.mp3"}
+	filter := a.volumeFilter(1)
+
+	nameA, nameB := frameCacheName(a, filter), frameCacheName(b, filter)
+	if nameA == nameB {
+		t.Fatalf("both files are cached as %s", nameA)
+	}
+
+	for _, sound := range []*Sound{a, b} {
+		name := frameCacheName(sound, filter)
+		if err := os.WriteFile(filepath.Join(c.dir, name), []byte{0, 0}, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		c.add(name, sound.fileID(), 2)
+	}
+
+	c.invalidate(a.fileID())
+	if file := c.open(nameA); file != nil {
+		file.Close()
+		t.Error("a's frames are still cached after invalidating it")
+	}
+	file := c.open(nameB)
+	if file == nil {
+		t.Fatal("invalidating a dropped b's frames")
+	}
+	file.Close()
+}
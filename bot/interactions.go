@@ -0,0 +1,278 @@
+package bot
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// registerSlashCommands overwrites the guild's slash commands with the ones in commandSpecs
+func registerSlashCommands(d *discordgo.Session, guildID string) error {
+	applicationCommands := make([]*discordgo.ApplicationCommand, 0, len(commandSpecs))
+	for _, spec := range commandSpecs {
+		applicationCommands = append(applicationCommands, spec.applicationCommand())
+	}
+
+	_, err := d.ApplicationCommandBulkOverwrite(d.State.User.ID, guildID, applicationCommands)
+	return err
+}
+
+func interactionHandler(d *discordgo.Session, i *discordgo.InteractionCreate) {
+	if i.GuildID == "" || i.Member == nil {
+		return
+	}
+
+	switch i.Type {
+	case discordgo.InteractionApplicationCommand:
+		handleSlashCommand(d, i)
+	case discordgo.InteractionApplicationCommandAutocomplete:
+		handleAutocomplete(d, i)
+	case discordgo.InteractionMessageComponent:
+		handleComponent(d, i)
+	}
+}
+
+func handleSlashCommand(d *discordgo.Session, i *discordgo.InteractionCreate) {
+	data := i.ApplicationCommandData()
+	spec := commandBySlashName(data.Name)
+	if spec == nil {
+		return
+	}
+
+	runInteractionCommand(d, i, spec, slashCommandArgs(spec, data.Options))
+}
+
+// suggestions are buttons whose custom id is the whole command, "suggest <slash name> <args...>",
+// the args are path escaped so a sound name with spaces stays one arg
+const suggestionPrefix = "suggest"
+
+func suggestionCustomID(spec *commandSpec, args []string) string {
+	fields := []string{suggestionPrefix, spec.Name}
+	for _, arg := range args {
+		fields = append(fields, url.PathEscape(arg))
+	}
+	return strings.Join(fields, " ")
+}
+
+// suggestionArgs undoes the escaping in suggestionCustomID
+func suggestionArgs(fields []string) ([]string, error) {
+	args := make([]string, 0, len(fields))
+	for _, field := range fields {
+		arg, err := url.PathUnescape(field)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// handleComponent runs the command behind a "did you mean" button, resolves a duplicate upload (see duplicates.go)
+// or applies an edit preview (see edit.go)
+func handleComponent(d *discordgo.Session, i *discordgo.InteractionCreate) {
+	fields := strings.Fields(i.MessageComponentData().CustomID)
+	if len(fields) == 3 && fields[0] == uploadChoicePrefix {
+		handleUploadChoice(d, i, fields[1], fields[2])
+		return
+	}
+	if len(fields) == 3 && fields[0] == editChoicePrefix {
+		handleEditChoice(d, i, fields[1], fields[2])
+		return
+	}
+	if len(fields) < 2 || fields[0] != suggestionPrefix {
+		return
+	}
+
+	spec := commandBySlashName(fields[1])
+	if spec == nil {
+		return
+	}
+	args, err := suggestionArgs(fields[2:])
+	if err != nil {
+		logError("reading suggestion button", err, "guild", i.GuildID)
+		return
+	}
+
+	runInteractionCommand(d, i, spec, args)
+}
+
+func runInteractionCommand(d *discordgo.Session, i *discordgo.InteractionCreate, spec *commandSpec, args []string) {
+	responder := &interactionResponder{d: d, i: i.Interaction}
+	if spec.Deferred {
+		err := responder.deferReply()
+		if err != nil {
+			logError("deferring interaction response", err, "command", spec.Name, "guild", i.GuildID)
+			return
+		}
+	}
+
+	runCommand(spec, &commandRequest{
+		d:         d,
+		GuildID:   i.GuildID,
+		ChannelID: i.ChannelID,
+		User:      i.Member.User,
+		Args:      args,
+		responder: responder,
+	})
+
+	err := responder.finish()
+	if err != nil {
+		logError("answering interaction", err, "command", spec.Name, "guild", i.GuildID)
+	}
+}
+
+// discord shows at most 25 autocomplete choices
+const maxAutocompleteChoices = 25
+
+// handleAutocomplete suggests sound names for whichever sound option the user is typing in
+func handleAutocomplete(d *discordgo.Session, i *discordgo.InteractionCreate) {
+	choices := []*discordgo.ApplicationCommandOptionChoice{}
+
+	gState, ok := store.Guild(i.GuildID)
+	if ok {
+		for _, option := range i.ApplicationCommandData().Options {
+			if !option.Focused || option.Name != "sound" {
+				continue
+			}
+
+			for _, name := range rankSounds(gState.Sounds(), option.StringValue(), maxAutocompleteChoices) {
+				choices = append(choices, &discordgo.ApplicationCommandOptionChoice{
+					Name:  name,
+					Value: name,
+				})
+			}
+		}
+	}
+
+	err := d.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionApplicationCommandAutocompleteResult,
+		Data: &discordgo.InteractionResponseData{
+			Choices: choices,
+		},
+	})
+	if err != nil {
+		logError("sending autocomplete choices", err, "guild", i.GuildID)
+	}
+}
+
+// slashCommandArgs lines up the options in the order the comma command expects its arguments
+func slashCommandArgs(spec *commandSpec, options []*discordgo.ApplicationCommandInteractionDataOption) []string {
+	args := make([]string, 0, len(spec.Options))
+	for _, specOption := range spec.Options {
+		for _, option := range options {
+			if option.Name != specOption.Name {
+				continue
+			}
+
+			switch option.Type {
+			case discordgo.ApplicationCommandOptionInteger:
+				args = append(args, strconv.FormatInt(option.IntValue(), 10))
+			default:
+				args = append(args, fmt.Sprint(option.Value))
+			}
+		}
+	}
+	return args
+}
+
+// interactionResponder answers slash commands, the first message is the interaction response and the rest are followups
+type interactionResponder struct {
+	d         *discordgo.Session
+	i         *discordgo.Interaction
+	deferred  bool
+	responded bool
+}
+
+func (r *interactionResponder) deferReply() error {
+	r.deferred = true
+	return r.d.InteractionRespond(r.i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+	})
+}
+
+func (r *interactionResponder) respond(content string, flags discordgo.MessageFlags, components []discordgo.MessageComponent, files []*discordgo.File) error {
+	if r.responded {
+		_, err := r.d.FollowupMessageCreate(r.i, true, &discordgo.WebhookParams{
+			Content:    content,
+			Flags:      flags,
+			Components: components,
+			Files:      files,
+		})
+		return err
+	}
+	r.responded = true
+
+	if r.deferred {
+		// a deferred response is already public, drop it so errors can still be ephemeral
+		if flags&discordgo.MessageFlagsEphemeral != 0 {
+			err := r.d.InteractionResponseDelete(r.i)
+			if err != nil {
+				return err
+			}
+			_, err = r.d.FollowupMessageCreate(r.i, true, &discordgo.WebhookParams{
+				Content:    content,
+				Flags:      flags,
+				Components: components,
+				Files:      files,
+			})
+			return err
+		}
+
+		edit := &discordgo.WebhookEdit{Content: &content, Files: files}
+		if len(components) > 0 {
+			edit.Components = &components
+		}
+		_, err := r.d.InteractionResponseEdit(r.i, edit)
+		return err
+	}
+
+	return r.d.InteractionRespond(r.i, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content:    content,
+			Flags:      flags,
+			Components: components,
+			Files:      files,
+		},
+	})
+}
+
+func (r *interactionResponder) Reply(content string) error {
+	return r.respond(content, 0, nil, nil)
+}
+
+func (r *interactionResponder) Send(content string) error {
+	return r.respond(content, 0, nil, nil)
+}
+
+func (r *interactionResponder) Error(content string) error {
+	return r.respond(content, discordgo.MessageFlagsEphemeral, nil, nil)
+}
+
+func (r *interactionResponder) Ack(content string) error {
+	return r.respond(content, discordgo.MessageFlagsEphemeral, nil, nil)
+}
+
+func (r *interactionResponder) Suggest(content string, components []discordgo.MessageComponent) error {
+	return r.respond(content, discordgo.MessageFlagsEphemeral, components, nil)
+}
+
+func (r *interactionResponder) SendFile(content string, name string, file io.Reader) error {
+	return r.respond(content, 0, nil, []*discordgo.File{{Name: name, Reader: file}})
+}
+
+func (r *interactionResponder) Preview(content string, name string, file io.Reader, components []discordgo.MessageComponent) error {
+	return r.respond(content, 0, components, []*discordgo.File{{Name: name, Reader: file}})
+}
+
+// finish makes sure discord got an answer, otherwise the user sees "The application did not respond"
+func (r *interactionResponder) finish() error {
+	if r.responded {
+		return nil
+	}
+	return r.Ack("Done")
+}
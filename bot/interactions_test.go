@@ -0,0 +1,21 @@
+package bot
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSuggestionCustomIDRoundTrip(t *testing.T) {
+	spec := &commandSpec{Name: "play"}
+	args := []string{"air horn", "50%", "ação"}
+
+	fields := strings.Fields(suggestionCustomID(spec, args))
+	if len(fields) != 2+len(args) || fields[0] != suggestionPrefix || fields[1] != "play" {
+		t.Fatalf("custom id fields = %q", fields)
+	}
+	got, err := suggestionArgs(fields[2:])
+	if err != nil || !slices.Equal(got, args) {
+		t.Errorf("suggestionArgs = %q, %v, want %q", got, err, args)
+	}
+}
@@ -0,0 +1,164 @@
+package bot
+
+import (
+	"sort"
+	"strings"
+)
+
+// match tiers, lower is better
+const (
+	matchPrefix = iota
+	matchSubstring
+	matchFuzzy
+	noMatch
+)
+
+type rankedName struct {
+	name  string
+	tier  int
+	score int
+}
+
+// rankSounds returns up to limit sound names matching query, prefix matches first, then substring, then fuzzy
+func rankSounds(sList SoundList, query string, limit int) []string {
+	query = strings.ToLower(query)
+
+	ranked := make([]rankedName, 0, len(sList))
+	for name := range sList {
+		tier, score := matchName(strings.ToLower(name), query)
+		if tier == noMatch {
+			continue
+		}
+		ranked = append(ranked, rankedName{name: name, tier: tier, score: score})
+	}
+
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].tier != ranked[j].tier {
+			return ranked[i].tier < ranked[j].tier
+		}
+		if ranked[i].score != ranked[j].score {
+			return ranked[i].score < ranked[j].score
+		}
+		return ranked[i].name < ranked[j].name
+	})
+
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+
+	names := make([]string, 0, len(ranked))
+	for _, r := range ranked {
+		names = append(names, r.name)
+	}
+	return names
+}
+
+// matchName works on lowercased strings, score orders names inside the same tier
+func matchName(name string, query string) (int, int) {
+	if query == "" {
+		return matchPrefix, 0
+	}
+
+	if strings.HasPrefix(name, query) {
+		return matchPrefix, len(name) - len(query)
+	}
+
+	if idx := strings.Index(name, query); idx >= 0 {
+		return matchSubstring, idx
+	}
+
+	// typos, "airhron" should still find "airhorn"
+	if dist := levenshtein(name, query); dist <= maxTypos(query) {
+		return matchFuzzy, dist
+	}
+
+	// abbreviations, "ahn" should still find "airhorn"
+	if span, ok := subsequenceSpan(name, query); ok {
+		return matchFuzzy, span
+	}
+
+	return noMatch, 0
+}
+
+// maxTypos is how many edits a query can be off by and still count as a fuzzy match
+func maxTypos(query string) int {
+	if len(query) < 4 {
+		return 1
+	}
+	return len(query) / 3
+}
+
+// subsequenceSpan checks if every character of query shows up in name in order, the score is how spread out they are
+func subsequenceSpan(name string, query string) (int, bool) {
+	start, qi := -1, 0
+	for i := 0; i < len(name) && qi < len(query); i++ {
+		if name[i] == query[qi] {
+			if start < 0 {
+				start = i
+			}
+			qi++
+			if qi == len(query) {
+				return i - start + 1, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func levenshtein(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+// maxSuggestions fits in a single row of buttons
+const maxSuggestions = 5
+
+// resolveSound looks a sound up by exact name, then case-insensitive, then prefix, then typos
+// it only settles on a sound when there's a single candidate, otherwise it returns the best candidates to suggest
+func resolveSound(sList SoundList, term string) (string, *Sound, []string) {
+	if sound, ok := sList[term]; ok {
+		return term, sound, nil
+	}
+
+	lowerTerm := strings.ToLower(term)
+	var caseInsensitive, prefix, typos []string
+	for name := range sList {
+		lowerName := strings.ToLower(name)
+		switch {
+		case lowerName == lowerTerm:
+			caseInsensitive = append(caseInsensitive, name)
+		case strings.HasPrefix(lowerName, lowerTerm):
+			prefix = append(prefix, name)
+		case levenshtein(lowerName, lowerTerm) <= maxTypos(lowerTerm):
+			typos = append(typos, name)
+		}
+	}
+
+	for _, matches := range [][]string{caseInsensitive, prefix, typos} {
+		if len(matches) == 1 {
+			return matches[0], sList[matches[0]], nil
+		}
+		if len(matches) > 1 {
+			break
+		}
+	}
+
+	return "", nil, rankSounds(sList, term, maxSuggestions)
+}
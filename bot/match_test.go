@@ -0,0 +1,97 @@
+package bot
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func testSoundList(names ...string) SoundList {
+	sList := make(SoundList, len(names))
+	for _, name := range names {
+		sList[name] = &Sound{MessageID: name}
+	}
+	return sList
+}
+
+func TestResolveSound(t *testing.T) {
+	sList := testSoundList("airhorn", "airhorn_long", "horn", "Bruh", "bruh2", "wow", "yeet")
+
+	tests := []struct {
+		term        string
+		want        string
+		suggestions []string
+	}{
+		{term: "airhorn", want: "airhorn"},
+		// case-insensitive beats the prefix match bruh2
+		{term: "bruh", want: "Bruh"},
+		{term: "yee", want: "yeet"},
+		{term: "woww", want: "wow"},
+		// two prefix matches is a question, not a guess
+		{term: "airh", suggestions: []string{"airhorn", "airhorn_long"}},
+		{term: "zzz"},
+	}
+	for _, tt := range tests {
+		name, sound, suggestions := resolveSound(sList, tt.term)
+		if name != tt.want || (sound != nil) != (tt.want != "") {
+			t.Errorf("resolveSound(%q) = %q, want %q", tt.term, name, tt.want)
+		}
+		if !slices.Equal(suggestions, tt.suggestions) {
+			t.Errorf("resolveSound(%q) suggests %v, want %v", tt.term, suggestions, tt.suggestions)
+		}
+	}
+}
+
+func TestRankSounds(t *testing.T) {
+	sList := testSoundList("airhorn", "airhorn_long", "horn", "Bruh", "wow", "yeet")
+
+	tests := []struct {
+		query string
+		limit int
+		want  []string
+	}{
+		// everything matches an empty query, by name
+		{query: "", limit: 3, want: []string{"Bruh", "airhorn", "airhorn_long"}},
+		// prefix, then substring
+		{query: "horn", limit: 25, want: []string{"horn", "airhorn", "airhorn_long"}},
+		{query: "HORN", limit: 1, want: []string{"horn"}},
+		// typos and abbreviations
+		{query: "yeat", limit: 25, want: []string{"yeet"}},
+		{query: "ahn", limit: 25, want: []string{"airhorn", "airhorn_long"}},
+		{query: "zzz", limit: 25, want: []string{}},
+	}
+	for _, tt := range tests {
+		if got := rankSounds(sList, tt.query, tt.limit); !slices.Equal(got, tt.want) {
+			t.Errorf("rankSounds(%q, %d) = %v, want %v", tt.query, tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestRankSoundsLimit(t *testing.T) {
+	sList := make(SoundList)
+	for i := 0; i < 40; i++ {
+		sList["sound"+strconv.Itoa(i)] = &Sound{}
+	}
+	if got := rankSounds(sList, "so", maxAutocompleteChoices); len(got) != maxAutocompleteChoices {
+		t.Errorf("%d autocomplete choices, want %d", len(got), maxAutocompleteChoices)
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "abc", 3},
+		{"airhorn", "airhorn", 0},
+		{"airhron", "airhorn", 2},
+		{"kitten", "sitting", 3},
+		// runes, not bytes
+		{"ação", "acao", 2},
+	}
+	for _, tt := range tests {
+		if got := levenshtein(tt.a, tt.b); got != tt.want {
+			t.Errorf("levenshtein(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+// Package metadata encodes the per sound settings the bot keeps in the content of a sound's message.
+//
+// The current format is a schema header followed by url encoded values:
+//
+//	meta/3?entrance=1234&entrance=5678&loudness=-18.2&peak=-0.4&volume=80
+//
+// Messages written before the header existed look like "e:userID;v:volume;" (version 1),
+// Decode reads all of them and Encode always writes the current version. A header whose version
+// isn't a number, or is newer than Version, is an error, rewriting it would lose whatever it held.
+//
+// Volumes are in percent of the original file since version 3, before that they were in dca's scale
+// (256 was the original volume) and 0 meant the volume was never set. Decode converts old volumes to percent.
+package metadata
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Version is the schema Encode writes
+const Version = 3
+
+// percentVersion is the first schema with volumes in percent
+const percentVersion = 3
+
+const header = "meta/"
+
+// ErrBadVersion means the content has a metadata header but no version Decode can read, or one newer than Version
+var ErrBadVersion = errors.New("unreadable metadata version")
+
+// Metadata is everything stored for a sound besides the file itself
+type Metadata struct {
+	// Version is the schema the content was written in, 0 if the message had no metadata
+	Version int
+	// Volume is in percent of the original file (0 is muted), nil if it was never set
+	Volume *int
+	// Entrances are the IDs of users that have this sound as their entrance
+	Entrances []string
+	// Loudness is the sound's integrated loudness in LUFS and Peak its true peak in dBTP, Loudness is 0 if it was never measured
+	Loudness float64
+	Peak     float64
+	// Extra keeps keys this version doesn't know about, so they survive a decode/encode round trip
+	Extra url.Values
+}
+
+// Decode parses a message's content, values it can't make sense of are skipped rather than failing the whole sound,
+// only a header without a readable version (or a newer one) is an error (ErrBadVersion)
+func Decode(content string) (Metadata, error) {
+	content = strings.TrimSpace(content)
+	if content == "" {
+		return Metadata{}, nil
+	}
+
+	if strings.HasPrefix(content, header) {
+		return decodeCurrent(content)
+	}
+	return decodeLegacy(content), nil
+}
+
+func decodeCurrent(content string) (Metadata, error) {
+	versionStr, query, _ := strings.Cut(strings.TrimPrefix(content, header), "?")
+
+	version, err := strconv.Atoi(versionStr)
+	if err != nil || version <= 0 {
+		return Metadata{}, fmt.Errorf("%w: %q", ErrBadVersion, versionStr)
+	}
+	// a newer bot wrote it, what that version added can't be told apart from what it changed
+	if version > Version {
+		return Metadata{}, fmt.Errorf("%w: %d is newer than %d", ErrBadVersion, version, Version)
+	}
+	m := Metadata{Version: version}
+
+	// ParseQuery keeps every pair it managed to parse even when it returns an error
+	values, _ := url.ParseQuery(query)
+	for key, vals := range values {
+		switch key {
+		case "volume":
+			if volume, err := strconv.Atoi(vals[0]); err == nil && volume >= 0 {
+				m.Volume = &volume
+			}
+		case "entrance":
+			for _, userID := range vals {
+				m.AddEntrance(userID)
+			}
+		case "loudness":
+			if loudness, err := strconv.ParseFloat(vals[0], 64); err == nil && loudness < 0 {
+				m.Loudness = loudness
+			}
+		case "peak":
+			if peak, err := strconv.ParseFloat(vals[0], 64); err == nil {
+				m.Peak = peak
+			}
+		default:
+			if m.Extra == nil {
+				m.Extra = url.Values{}
+			}
+			m.Extra[key] = vals
+		}
+	}
+
+	if m.Version < percentVersion && m.Volume != nil {
+		m.Volume = PercentFromDCA(*m.Volume)
+	}
+	return m, nil
+}
+
+// decodeLegacy reads the "e:userID;v:volume;" tags, content without any is no metadata at all (version 0)
+func decodeLegacy(content string) Metadata {
+	m := Metadata{}
+
+	for _, tag := range strings.Split(content, ";") {
+		tagType, tagValue, ok := strings.Cut(strings.TrimSpace(tag), ":")
+		if !ok || tagValue == "" {
+			continue
+		}
+
+		switch tagType {
+		case "e":
+			m.AddEntrance(tagValue)
+			m.Version = 1
+		case "v":
+			if volume, err := strconv.Atoi(tagValue); err == nil && volume >= 0 {
+				m.Volume = PercentFromDCA(volume)
+				m.Version = 1
+			}
+		}
+	}
+
+	return m
+}
+
+// Encode writes the metadata in the current format, empty metadata encodes to an empty string
+func (m Metadata) Encode() string {
+	values := url.Values{}
+	for key, vals := range m.Extra {
+		values[key] = vals
+	}
+
+	if m.Volume != nil {
+		values.Set("volume", strconv.Itoa(*m.Volume))
+	}
+	for _, userID := range m.Entrances {
+		values.Add("entrance", userID)
+	}
+	if m.Loudness != 0 {
+		values.Set("loudness", strconv.FormatFloat(m.Loudness, 'f', 1, 64))
+		values.Set("peak", strconv.FormatFloat(m.Peak, 'f', 1, 64))
+	}
+
+	if len(values) == 0 {
+		return ""
+	}
+	return header + strconv.Itoa(Version) + "?" + values.Encode()
+}
+
+// PercentFromDCA converts a volume in dca's scale (256 is the original volume) to percent,
+// 0 was what an unset volume looked like in that scale so it converts to nil
+func PercentFromDCA(volume int) *int {
+	if volume <= 0 {
+		return nil
+	}
+	percent := (volume*100 + 128) / 256
+	return &percent
+}
+
+// NeedsMigration is true when the content was written in an older format and should be rewritten
+func (m Metadata) NeedsMigration() bool {
+	return m.Version != 0 && m.Version < Version
+}
+
+func (m Metadata) HasEntrance(userID string) bool {
+	return slices.Contains(m.Entrances, userID)
+}
+
+// AddEntrance returns false if the user already had this entrance
+func (m *Metadata) AddEntrance(userID string) bool {
+	if m.HasEntrance(userID) {
+		return false
+	}
+	m.Entrances = append(m.Entrances, userID)
+	return true
+}
+
+// RemoveEntrance returns false if the user didn't have this entrance
+func (m *Metadata) RemoveEntrance(userID string) bool {
+	idx := slices.Index(m.Entrances, userID)
+	if idx < 0 {
+		return false
+	}
+	m.Entrances = slices.Delete(m.Entrances, idx, idx+1)
+	return true
+}
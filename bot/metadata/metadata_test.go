@@ -0,0 +1,230 @@
+package metadata
+
+import (
+	"errors"
+	"net/url"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func intPtr(v int) *int {
+	return &v
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		meta Metadata
+	}{
+		{"volume", Metadata{Volume: intPtr(80)}},
+		{"muted", Metadata{Volume: intPtr(0)}},
+		{"entrances", Metadata{Entrances: []string{"1234", "5678"}}},
+		{"loudness", Metadata{Loudness: -18.2, Peak: -0.4}},
+		{"extra", Metadata{Volume: intPtr(120), Extra: url.Values{"future": {"a", "b"}}}},
+		{"everything", Metadata{
+			Volume:    intPtr(150),
+			Entrances: []string{"1234"},
+			Loudness:  -23.5,
+			Peak:      -3.1,
+			Extra:     url.Values{"future": {"x"}},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded := tt.meta.Encode()
+			decoded, err := Decode(encoded)
+			if err != nil {
+				t.Fatalf("Decode(%q): %v", encoded, err)
+			}
+
+			want := tt.meta
+			want.Version = Version
+			if !reflect.DeepEqual(decoded, want) {
+				t.Errorf("Decode(%q) = %+v, want %+v", encoded, decoded, want)
+			}
+			if again := decoded.Encode(); again != encoded {
+				t.Errorf("encoding again = %q, want %q", again, encoded)
+			}
+			if decoded.NeedsMigration() {
+				t.Errorf("current metadata needs migration")
+			}
+		})
+	}
+}
+
+func TestEncodeEmpty(t *testing.T) {
+	if encoded := (Metadata{}).Encode(); encoded != "" {
+		t.Errorf("empty metadata encoded to %q", encoded)
+	}
+}
+
+func TestDecodeLegacy(t *testing.T) {
+	tests := []struct {
+		content string
+		want    Metadata
+	}{
+		{"e:1234;v:128;", Metadata{Version: 1, Volume: intPtr(50), Entrances: []string{"1234"}}},
+		{"e:1234;e:5678;", Metadata{Version: 1, Entrances: []string{"1234", "5678"}}},
+		{"e:1234;e:1234;", Metadata{Version: 1, Entrances: []string{"1234"}}},
+		{" v:256 ", Metadata{Version: 1, Volume: intPtr(100)}},
+		// 0 was an unset volume in dca's scale
+		{"v:0;", Metadata{Version: 1}},
+		{"v:loud;e:1234", Metadata{Version: 1, Entrances: []string{"1234"}}},
+	}
+
+	for _, tt := range tests {
+		got, err := Decode(tt.content)
+		if err != nil {
+			t.Errorf("Decode(%q): %v", tt.content, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Decode(%q) = %+v, want %+v", tt.content, got, tt.want)
+		}
+		if !got.NeedsMigration() {
+			t.Errorf("Decode(%q) doesn't need migration", tt.content)
+		}
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	for _, content := range []string{"", "   ", "foo", "v:", "e:", "v:-5", ";;;", "meta", "hello: world"} {
+		got, err := Decode(content)
+		if err != nil {
+			t.Errorf("Decode(%q): %v", content, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, Metadata{}) {
+			t.Errorf("Decode(%q) = %+v, want no metadata", content, got)
+		}
+		if got.NeedsMigration() {
+			t.Errorf("Decode(%q) needs migration, there's nothing to migrate", content)
+		}
+	}
+}
+
+func TestDecodeSkipsBadValues(t *testing.T) {
+	got, err := Decode("meta/3?volume=loud&loudness=3&peak=x&entrance=1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Metadata{Version: 3, Entrances: []string{"1234"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestDecodeBadVersion(t *testing.T) {
+	for _, content := range []string{"meta/?volume=80", "meta/x?volume=80", "meta/0?volume=80", "meta/-1", "meta/3.0?volume=80"} {
+		_, err := Decode(content)
+		if !errors.Is(err, ErrBadVersion) {
+			t.Errorf("Decode(%q) = %v, want ErrBadVersion", content, err)
+		}
+	}
+}
+
+func TestMigration(t *testing.T) {
+	tests := []struct {
+		content string
+		volume  *int
+		encoded string
+	}{
+		{"e:1234;v:512;", intPtr(200), "meta/3?entrance=1234&volume=200"},
+		{"meta/2?volume=256&loudness=-20.0&peak=-1.0", intPtr(100), "meta/3?loudness=-20.0&peak=-1.0&volume=100"},
+		{"meta/2?volume=0", nil, ""},
+		{"meta/1?volume=64&future=1", intPtr(25), "meta/3?future=1&volume=25"},
+	}
+
+	for _, tt := range tests {
+		got, err := Decode(tt.content)
+		if err != nil {
+			t.Errorf("Decode(%q): %v", tt.content, err)
+			continue
+		}
+		if !got.NeedsMigration() {
+			t.Errorf("Decode(%q) doesn't need migration", tt.content)
+		}
+		if !reflect.DeepEqual(got.Volume, tt.volume) {
+			t.Errorf("Decode(%q) volume = %v, want %v", tt.content, got.Volume, tt.volume)
+		}
+		if encoded := got.Encode(); encoded != tt.encoded {
+			t.Errorf("migrating %q = %q, want %q", tt.content, encoded, tt.encoded)
+		}
+	}
+}
+
+func TestPercentFromDCA(t *testing.T) {
+	tests := []struct {
+		volume int
+		want   *int
+	}{
+		{0, nil},
+		{-1, nil},
+		{1, intPtr(0)},
+		{128, intPtr(50)},
+		{256, intPtr(100)},
+		{512, intPtr(200)},
+	}
+	for _, tt := range tests {
+		if got := PercentFromDCA(tt.volume); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("PercentFromDCA(%d) = %v, want %v", tt.volume, got, tt.want)
+		}
+	}
+}
+
+func TestEntrances(t *testing.T) {
+	var m Metadata
+	if !m.AddEntrance("1") || m.AddEntrance("1") {
+		t.Error("AddEntrance should only add a user once")
+	}
+	m.AddEntrance("2")
+	if !m.RemoveEntrance("1") || m.RemoveEntrance("1") {
+		t.Error("RemoveEntrance should only remove a user once")
+	}
+	if !reflect.DeepEqual(m.Entrances, []string{"2"}) {
+		t.Errorf("entrances = %v, want [2]", m.Entrances)
+	}
+}
+
+func TestSettingsRoundTrip(t *testing.T) {
+	s := Settings{
+		Volume:      intPtr(120),
+		UserVolumes: map[string]int{"1234": 80, "5678": 0},
+		Tokens:      map[string]Token{"9f2c": {CreatedBy: "1234", Expires: time.Unix(1767225600, 0)}},
+		Extra:       url.Values{"future": {"1"}},
+	}
+
+	encoded := s.Encode()
+	if !IsSettings(encoded) {
+		t.Fatalf("%q isn't recognized as settings", encoded)
+	}
+	if decoded := DecodeSettings(encoded); !reflect.DeepEqual(decoded, s) {
+		t.Errorf("DecodeSettings(%q) = %+v, want %+v", encoded, decoded, s)
+	}
+}
+
+func TestSettingsEmpty(t *testing.T) {
+	encoded := Settings{}.Encode()
+	if !IsSettings(encoded) {
+		t.Fatalf("empty settings encoded to %q, which isn't recognized", encoded)
+	}
+	decoded := DecodeSettings(encoded)
+	if decoded.Volume != nil || len(decoded.UserVolumes) != 0 || len(decoded.Tokens) != 0 {
+		t.Errorf("DecodeSettings(%q) = %+v, want empty settings", encoded, decoded)
+	}
+	if IsSettings("meta/3?volume=80") {
+		t.Error("sound metadata recognized as settings")
+	}
+}
+
+func TestDecodeNewerVersion(t *testing.T) {
+	// re-encoding this as the current version would drop whatever the newer one added
+	content := "meta/" + strconv.Itoa(Version+1) + "?volume=80&added=1"
+	got, err := Decode(content)
+	if !errors.Is(err, ErrBadVersion) {
+		t.Errorf("Decode(%q) = %+v, %v, want ErrBadVersion", content, got, err)
+	}
+}
@@ -0,0 +1,110 @@
+package metadata
+
+import (
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Guild wide settings live in a message of their own (no file) in the same url encoded style as sound metadata:
+//
+//	settings/1?token=9f2c%3A1767225600%3A1234&user=1234%3A80&volume=120
+
+// SettingsVersion is the schema EncodeSettings writes
+const SettingsVersion = 1
+
+const settingsHeader = "settings/"
+
+// Settings are a guild's playback settings, volumes are in percent of the original like Metadata.Volume
+type Settings struct {
+	// Volume is the guild's master volume, nil if it was never set
+	Volume *int
+	// UserVolumes [UserID] is how loud the sounds a user triggers play
+	UserVolumes map[string]int
+	// Tokens [TokenID] are the guild's API tokens that weren't revoked, only their IDs (the secret signs them)
+	Tokens map[string]Token
+	// Extra keeps keys this version doesn't know about, so they survive a decode/encode round trip
+	Extra url.Values
+}
+
+// Token is an API token, it acts as the member who created it until it expires
+type Token struct {
+	CreatedBy string
+	Expires   time.Time
+}
+
+// IsSettings is true for a message's content that holds guild settings
+func IsSettings(content string) bool {
+	return strings.HasPrefix(strings.TrimSpace(content), settingsHeader)
+}
+
+// DecodeSettings parses a settings message's content, values it can't make sense of are skipped
+func DecodeSettings(content string) Settings {
+	s := Settings{UserVolumes: make(map[string]int), Tokens: make(map[string]Token)}
+	_, query, _ := strings.Cut(strings.TrimPrefix(strings.TrimSpace(content), settingsHeader), "?")
+
+	values, _ := url.ParseQuery(query)
+	for key, vals := range values {
+		switch key {
+		case "volume":
+			if volume, err := strconv.Atoi(vals[0]); err == nil && volume >= 0 {
+				s.Volume = &volume
+			}
+		case "user":
+			for _, val := range vals {
+				userID, volumeStr, _ := strings.Cut(val, ":")
+				if volume, err := strconv.Atoi(volumeStr); err == nil && volume >= 0 && userID != "" {
+					s.UserVolumes[userID] = volume
+				}
+			}
+		case "token":
+			for _, val := range vals {
+				parts := strings.SplitN(val, ":", 3)
+				if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+					continue
+				}
+				if expires, err := strconv.ParseInt(parts[1], 10, 64); err == nil {
+					s.Tokens[parts[0]] = Token{CreatedBy: parts[2], Expires: time.Unix(expires, 0)}
+				}
+			}
+		default:
+			if s.Extra == nil {
+				s.Extra = url.Values{}
+			}
+			s.Extra[key] = vals
+		}
+	}
+	return s
+}
+
+// Encode writes the settings, unlike Metadata.Encode it never returns an empty string so the message stays recognizable
+func (s Settings) Encode() string {
+	values := url.Values{}
+	for key, vals := range s.Extra {
+		values[key] = vals
+	}
+
+	if s.Volume != nil {
+		values.Set("volume", strconv.Itoa(*s.Volume))
+	}
+	userIDs := make([]string, 0, len(s.UserVolumes))
+	for userID := range s.UserVolumes {
+		userIDs = append(userIDs, userID)
+	}
+	slices.Sort(userIDs)
+	for _, userID := range userIDs {
+		values.Add("user", userID+":"+strconv.Itoa(s.UserVolumes[userID]))
+	}
+	tokenIDs := make([]string, 0, len(s.Tokens))
+	for tokenID := range s.Tokens {
+		tokenIDs = append(tokenIDs, tokenID)
+	}
+	slices.Sort(tokenIDs)
+	for _, tokenID := range tokenIDs {
+		token := s.Tokens[tokenID]
+		values.Add("token", tokenID+":"+strconv.FormatInt(token.Expires.Unix(), 10)+":"+token.CreatedBy)
+	}
+	return settingsHeader + strconv.Itoa(SettingsVersion) + "?" + values.Encode()
+}
@@ -0,0 +1,352 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// QueueItem is a sound waiting to be played in a guild
+type QueueItem struct {
+	// ID is set when the item is queued, it's only unique within the guild and until the bot restarts
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Sound       *Sound `json:"-"`
+	ChannelID   string `json:"channelId"`
+	RequestedBy string `json:"requestedBy"`
+}
+
+// PlaybackStatus is where a queued item is in its life, queued and playing are the only ones that still change
+type PlaybackStatus string
+
+const (
+	StatusQueued  PlaybackStatus = "queued"
+	StatusPlaying PlaybackStatus = "playing"
+	StatusDone    PlaybackStatus = "done"
+	StatusSkipped PlaybackStatus = "skipped"
+	StatusCleared PlaybackStatus = "cleared"
+	StatusFailed  PlaybackStatus = "failed"
+)
+
+// Playback is where a queued item is at, see PlaybackQueue.Playback
+type Playback struct {
+	ID     string         `json:"id"`
+	Status PlaybackStatus `json:"status"`
+	Error  string         `json:"error,omitempty"`
+	Item   *QueueItem     `json:"item"`
+}
+
+// maxFinishedPlaybacks is how many finished playbacks are kept around for status lookups
+const maxFinishedPlaybacks = 100
+
+// PlaybackQueue is a FIFO of sounds for a single guild
+// only the player goroutine started by run takes items out of it, so sounds play in the order they were queued
+type PlaybackQueue struct {
+	guildID string
+	mu      sync.Mutex
+	items   []*QueueItem
+	current *QueueItem
+	stop    chan struct{}
+	wake    chan struct{}
+	closed  bool
+	// exited is closed when the player goroutine returns
+	exited chan struct{}
+
+	seq       int
+	playbacks map[string]*Playback
+	// finished are the IDs of finished playbacks, oldest first
+	finished []string
+}
+
+func newPlaybackQueue(guildID string) *PlaybackQueue {
+	return &PlaybackQueue{
+		guildID:   guildID,
+		wake:      make(chan struct{}, 1),
+		exited:    make(chan struct{}),
+		playbacks: make(map[string]*Playback),
+	}
+}
+
+// Enqueue adds an item to the end of the queue and returns its position (1 is next up)
+// a closed queue doesn't take new items and returns 0
+func (q *PlaybackQueue) Enqueue(item *QueueItem) int {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return 0
+	}
+	q.items = append(q.items, item)
+	pos := len(q.items)
+	q.track(item)
+	q.changed()
+	q.mu.Unlock()
+
+	q.notify()
+	return pos
+}
+
+// SkipTo puts an item at the front of the queue and stops the sound playing, used by ,ss <sound-name>.
+// both happen under one lock, an idle player can't take the item first and have it skipped right away.
+// returns false if nothing was playing
+func (q *PlaybackQueue) SkipTo(item *QueueItem) bool {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return false
+	}
+	q.items = append([]*QueueItem{item}, q.items...)
+	q.track(item)
+	skipped := q.stop != nil
+	if skipped {
+		close(q.stop)
+		q.stop = nil
+	}
+	q.changed()
+	q.mu.Unlock()
+
+	q.notify()
+	return skipped
+}
+
+// Skip stops the sound currently playing, the player moves on to the next item
+// returns false if nothing was playing
+func (q *PlaybackQueue) Skip() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.stop == nil {
+		return false
+	}
+	close(q.stop)
+	q.stop = nil
+	return true
+}
+
+// Clear drops every pending item, the current sound keeps playing
+func (q *PlaybackQueue) Clear() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := len(q.items)
+	for _, item := range q.items {
+		q.setStatus(item.ID, StatusCleared, "")
+	}
+	q.items = nil
+	q.changed()
+	return n
+}
+
+// Snapshot returns the item playing right now (nil if idle) and a copy of the pending items
+func (q *PlaybackQueue) Snapshot() (*QueueItem, []*QueueItem) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	pending := make([]*QueueItem, len(q.items))
+	copy(pending, q.items)
+	return q.current, pending
+}
+
+// Close drops the pending items, stops the current sound and makes the player return, see Done
+func (q *PlaybackQueue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	for _, item := range q.items {
+		q.setStatus(item.ID, StatusCleared, "")
+	}
+	q.items = nil
+	if q.stop != nil {
+		close(q.stop)
+		q.stop = nil
+	}
+	q.changed()
+	q.mu.Unlock()
+
+	q.notify()
+}
+
+// Done is closed once the player has stopped after Close
+func (q *PlaybackQueue) Done() <-chan struct{} {
+	return q.exited
+}
+
+// Playback returns the status of a queued item by its ID
+func (q *PlaybackQueue) Playback(id string) (Playback, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	playback, ok := q.playbacks[id]
+	if !ok {
+		return Playback{}, false
+	}
+	return *playback, true
+}
+
+// track gives a new item its ID and starts tracking its status, q.mu has to be held
+func (q *PlaybackQueue) track(item *QueueItem) {
+	q.seq++
+	item.ID = strconv.Itoa(q.seq)
+	q.playbacks[item.ID] = &Playback{ID: item.ID, Item: item}
+	q.setStatus(item.ID, StatusQueued, "")
+}
+
+// setStatus updates and publishes a playback's status, finished playbacks are kept until there are too many, q.mu has to be held
+func (q *PlaybackQueue) setStatus(id string, status PlaybackStatus, errMsg string) {
+	playback, ok := q.playbacks[id]
+	if !ok {
+		return
+	}
+	playback.Status = status
+	playback.Error = errMsg
+	events.Publish(q.guildID, EventPlaybackStatus, *playback)
+
+	if status == StatusQueued || status == StatusPlaying {
+		return
+	}
+	q.finished = append(q.finished, id)
+	for len(q.finished) > maxFinishedPlaybacks {
+		delete(q.playbacks, q.finished[0])
+		q.finished = q.finished[1:]
+	}
+}
+
+// changed publishes the queue as it is now, q.mu has to be held
+func (q *PlaybackQueue) changed() {
+	pending := make([]*QueueItem, len(q.items))
+	copy(pending, q.items)
+	events.Publish(q.guildID, EventQueueUpdate, queueEvent{NowPlaying: q.current, Queue: pending})
+}
+
+func (q *PlaybackQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next pops the first item and marks it as current, blocking until there is one
+// returns nil once the queue is closed
+func (q *PlaybackQueue) next() (*QueueItem, chan struct{}) {
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return nil, nil
+		}
+		if len(q.items) > 0 {
+			item := q.items[0]
+			q.items = q.items[1:]
+			q.current = item
+			q.stop = make(chan struct{})
+			stop := q.stop
+			q.setStatus(item.ID, StatusPlaying, "")
+			q.changed()
+			q.mu.Unlock()
+			return item, stop
+		}
+		q.mu.Unlock()
+
+		<-q.wake
+	}
+}
+
+// done marks the current item as finished, err is why it failed (if it did)
+func (q *PlaybackQueue) done(item *QueueItem, stop <-chan struct{}, err error) {
+	q.mu.Lock()
+	select {
+	case <-stop:
+		q.setStatus(item.ID, StatusSkipped, "")
+	default:
+		if err != nil {
+			q.setStatus(item.ID, StatusFailed, userMessage(err))
+		} else {
+			q.setStatus(item.ID, StatusDone, "")
+		}
+	}
+	q.current = nil
+	q.stop = nil
+	q.changed()
+	q.mu.Unlock()
+}
+
+// run is the guild's player, one per guild until the queue is closed
+func (q *PlaybackQueue) run(d *discordgo.Session) {
+	defer close(q.exited)
+
+	for {
+		item, stop := q.next()
+		if item == nil {
+			return
+		}
+
+		events.Publish(q.guildID, EventPlaybackStart, playbackEvent{QueueItem: item})
+		// a sound that fails (or panics) only costs that sound, the player keeps going
+		err := callRecovered(func() error {
+			return play(d, q.guildID, item, stop)
+		})
+		stopped := playbackEvent{QueueItem: item}
+		if err != nil {
+			logError("playing sound", err, "guild", q.guildID, "sound", item.Name)
+			stopped.Error = userMessage(err)
+		}
+		events.Publish(q.guildID, EventPlaybackStop, stopped)
+		q.done(item, stop, err)
+	}
+}
+
+func play(d *discordgo.Session, guildID string, item *QueueItem, stop <-chan struct{}) error {
+	voice, err := d.ChannelVoiceJoin(guildID, item.ChannelID, false, false)
+	if err != nil {
+		return fmt.Errorf("joining voice channel: %w", err)
+	}
+	if voice == nil {
+		return errors.New("joining voice channel: no connection")
+	}
+
+	// a sound nobody measured yet plays as it is this time
+	measureLater(d, guildID, item.Name, item.Sound)
+	return PlayAudioFile(d, guildID, voice, item.Sound, item.RequestedBy, stop)
+}
+
+// formatQueue renders the queue for ,queue
+func formatQueue(current *QueueItem, pending []*QueueItem) string {
+	if current == nil && len(pending) == 0 {
+		return "Queue is empty"
+	}
+
+	output := "```"
+	if current != nil {
+		output += "Now playing: " + current.Name + "\n"
+	}
+	if len(pending) > 0 {
+		output += "\nUp next:\n"
+	}
+	for i, item := range pending {
+		line := fmt.Sprintf("%d. %s\n", i+1, item.Name)
+		// Discord max message length is 2000
+		if len(output)+len(line) > 1950 {
+			output += fmt.Sprintf("... and %d more\n", len(pending)-i)
+			break
+		}
+		output += line
+	}
+	return output + "```"
+}
+
+// waitVoiceReady waits for a voice connection to finish its handshake
+func waitVoiceReady(v *discordgo.VoiceConnection, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		v.RLock()
+		ready := v.Ready
+		v.RUnlock()
+		if ready {
+			return true
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return false
+}
@@ -0,0 +1,203 @@
+package bot
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func queueItem(name string) *QueueItem {
+	return &QueueItem{Name: name, Sound: &Sound{MessageID: name}, ChannelID: "voice"}
+}
+
+func itemNames(items []*QueueItem) []string {
+	names := make([]string, len(items))
+	for i, item := range items {
+		names[i] = item.Name
+	}
+	return names
+}
+
+// stopped is true once stop was closed
+func stopped(stop chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestPlaybackQueue(t *testing.T) {
+	tests := []struct {
+		name string
+		// run does something to the queue, a and b are queued and a is playing
+		run     func(t *testing.T, q *PlaybackQueue, stop chan struct{})
+		playing string
+		pending []string
+		// stopped is whether a was stopped
+		stopped bool
+	}{
+		{
+			name: "enqueue goes last",
+			run: func(t *testing.T, q *PlaybackQueue, _ chan struct{}) {
+				if pos := q.Enqueue(queueItem("c")); pos != 2 {
+					t.Errorf("Enqueue = %d, want 2", pos)
+				}
+			},
+			playing: "a",
+			pending: []string{"b", "c"},
+		},
+		{
+			name: "skip stops the current sound",
+			run: func(t *testing.T, q *PlaybackQueue, _ chan struct{}) {
+				if !q.Skip() {
+					t.Error("Skip = false with a playing")
+				}
+				if q.Skip() {
+					t.Error("skipping twice stopped something")
+				}
+			},
+			playing: "a",
+			pending: []string{"b"},
+			stopped: true,
+		},
+		{
+			name: "skip to goes first and stops the current sound",
+			run: func(t *testing.T, q *PlaybackQueue, _ chan struct{}) {
+				if !q.SkipTo(queueItem("c")) {
+					t.Error("SkipTo = false with a playing")
+				}
+			},
+			playing: "a",
+			pending: []string{"c", "b"},
+			stopped: true,
+		},
+		{
+			name: "clear keeps the current sound",
+			run: func(t *testing.T, q *PlaybackQueue, _ chan struct{}) {
+				if n := q.Clear(); n != 1 {
+					t.Errorf("Clear = %d, want 1", n)
+				}
+			},
+			playing: "a",
+		},
+		{
+			name: "close drops everything and takes nothing new",
+			run: func(t *testing.T, q *PlaybackQueue, _ chan struct{}) {
+				q.Close()
+				if pos := q.Enqueue(queueItem("c")); pos != 0 {
+					t.Errorf("Enqueue after Close = %d, want 0", pos)
+				}
+				if q.SkipTo(queueItem("d")) {
+					t.Error("SkipTo after Close = true")
+				}
+				if item, _ := q.next(); item != nil {
+					t.Errorf("next after Close = %s, want nil", item.Name)
+				}
+			},
+			playing: "a",
+			stopped: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newPlaybackQueue(testGuildID)
+			q.Enqueue(queueItem("a"))
+			q.Enqueue(queueItem("b"))
+			item, stop := q.next()
+			if item.Name != "a" {
+				t.Fatalf("next = %s, want a", item.Name)
+			}
+
+			tt.run(t, q, stop)
+
+			current, pending := q.Snapshot()
+			if current == nil || current.Name != tt.playing {
+				t.Errorf("playing %v, want %s", current, tt.playing)
+			}
+			if got := itemNames(pending); !slices.Equal(got, tt.pending) {
+				t.Errorf("pending %v, want %v", got, tt.pending)
+			}
+			if stopped(stop) != tt.stopped {
+				t.Errorf("a stopped = %v, want %v", stopped(stop), tt.stopped)
+			}
+		})
+	}
+}
+
+func TestPlaybackQueueFIFO(t *testing.T) {
+	q := newPlaybackQueue(testGuildID)
+	for i, name := range []string{"a", "b", "c"} {
+		if pos := q.Enqueue(queueItem(name)); pos != i+1 {
+			t.Errorf("Enqueue(%s) = %d, want %d", name, pos, i+1)
+		}
+	}
+	for _, want := range []string{"a", "b", "c"} {
+		item, stop := q.next()
+		if item.Name != want {
+			t.Fatalf("next = %s, want %s", item.Name, want)
+		}
+		q.done(item, stop, nil)
+	}
+}
+
+func TestSkipToWhileIdle(t *testing.T) {
+	q := newPlaybackQueue(testGuildID)
+	q.Enqueue(queueItem("a"))
+
+	// nothing playing, the item still goes first and the player takes it next
+	if q.SkipTo(queueItem("b")) {
+		t.Error("SkipTo = true with nothing playing")
+	}
+	item, stop := q.next()
+	if item.Name != "b" || stopped(stop) {
+		t.Errorf("next = %s (stopped %v), want b still playing", item.Name, stopped(stop))
+	}
+}
+
+func TestPlaybackStatuses(t *testing.T) {
+	q := newPlaybackQueue(testGuildID)
+	items := []*QueueItem{queueItem("done"), queueItem("skipped"), queueItem("failed"), queueItem("cleared")}
+	for _, item := range items {
+		q.Enqueue(item)
+	}
+
+	item, stop := q.next()
+	q.done(item, stop, nil)
+	item, stop = q.next()
+	q.Skip()
+	q.done(item, stop, errors.New("interrupted"))
+	item, stop = q.next()
+	q.done(item, stop, userErrorf("no voice"))
+	q.Clear()
+
+	for i, want := range []PlaybackStatus{StatusDone, StatusSkipped, StatusFailed, StatusCleared} {
+		playback, ok := q.Playback(items[i].ID)
+		if !ok || playback.Status != want {
+			t.Errorf("%s: %+v, want %s", items[i].Name, playback, want)
+		}
+	}
+	if playback, _ := q.Playback(items[2].ID); playback.Error != "no voice" {
+		t.Errorf("failed playback's error = %q", playback.Error)
+	}
+}
+
+func TestFinishedPlaybacksArePruned(t *testing.T) {
+	q := newPlaybackQueue(testGuildID)
+	items := make([]*QueueItem, maxFinishedPlaybacks+10)
+	for i := range items {
+		items[i] = queueItem("sound" + strconv.Itoa(i))
+		q.Enqueue(items[i])
+	}
+	q.Clear()
+
+	for i, item := range items {
+		_, ok := q.Playback(item.ID)
+		if want := i >= 10; ok != want {
+			t.Errorf("playback %d kept = %v, want %v", i, ok, want)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package bot
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// GuildSettings are a guild's playback settings, they apply on top of each sound's own volume
+type GuildSettings struct {
+	// Volume is the guild's master volume in percent, nil if it was never set
+	Volume *int `json:"volume,omitempty"`
+	// UserVolumes [UserID] is how loud the sounds a user triggers play, in percent
+	UserVolumes map[string]int `json:"userVolumes,omitempty"`
+	// Tokens [TokenID] are the API tokens that weren't revoked (see auth.go), they're left out of API answers by public
+	Tokens map[string]apiToken `json:"tokens,omitempty"`
+}
+
+// volumeScale is what a sound triggered by userID gets multiplied by, the master volume times the user's own
+func (s GuildSettings) volumeScale(userID string) float64 {
+	master := defaultVolume
+	if s.Volume != nil {
+		master = *s.Volume
+	}
+	user, ok := s.UserVolumes[userID]
+	if !ok {
+		user = defaultVolume
+	}
+	return float64(master) / 100 * float64(user) / 100
+}
+
+func (s GuildSettings) clone() GuildSettings {
+	s.UserVolumes = maps.Clone(s.UserVolumes)
+	if s.UserVolumes == nil {
+		s.UserVolumes = make(map[string]int)
+	}
+	s.Tokens = maps.Clone(s.Tokens)
+	if s.Tokens == nil {
+		s.Tokens = make(map[string]apiToken)
+	}
+	return s
+}
+
+// public is what members get to see of the settings, anyone can read them
+func (s GuildSettings) public() GuildSettings {
+	s.Tokens = nil
+	return s
+}
+
+// setMasterVolume sets the guild's master volume in percent, nil unsets it
+func setMasterVolume(d *discordgo.Session, guildID string, gState *GuildState, volume *int) (GuildSettings, error) {
+	if volume != nil && (*volume < 0 || *volume > maxVolume) {
+		return GuildSettings{}, userErrorf("Volume must be between 0 and %d%%", maxVolume)
+	}
+
+	return updateSettings(d, guildID, gState, func(settings *GuildSettings) error {
+		settings.Volume = volume
+		return nil
+	})
+}
+
+// setUserVolume sets how loud the sounds userID triggers play in percent, nil unsets it
+func setUserVolume(d *discordgo.Session, guildID string, gState *GuildState, userID string, volume *int) (GuildSettings, error) {
+	if volume != nil && (*volume < 0 || *volume > maxVolume) {
+		return GuildSettings{}, userErrorf("Volume must be between 0 and %d%%", maxVolume)
+	}
+
+	return updateSettings(d, guildID, gState, func(settings *GuildSettings) error {
+		if volume == nil {
+			delete(settings.UserVolumes, userID)
+		} else {
+			settings.UserVolumes[userID] = *volume
+		}
+		return nil
+	})
+}
+
+// updateSettings saves the guild's settings as change leaves them, nothing is saved if it returns an error.
+// One update runs at a time per guild so two at once can't save over each other
+func updateSettings(d *discordgo.Session, guildID string, gState *GuildState, change func(settings *GuildSettings) error) (GuildSettings, error) {
+	gState.settingsMu.Lock()
+	defer gState.settingsMu.Unlock()
+
+	settings := gState.Settings()
+	err := change(&settings)
+	if err != nil {
+		return GuildSettings{}, err
+	}
+
+	err = backend.SaveSettings(d, guildID, settings)
+	if expectedError(err) {
+		return GuildSettings{}, err
+	}
+	if err != nil {
+		return GuildSettings{}, failed("Error saving settings", err)
+	}
+
+	gState.SetSettings(settings)
+	return settings, nil
+}
+
+// formatVolume describes a volume in percent, nil is the default
+func formatVolume(volume *int) string {
+	if volume == nil {
+		return fmt.Sprintf("%d%% (default)", defaultVolume)
+	}
+	return fmt.Sprintf("%d%%", *volume)
+}
+
+// handleMasterVolume shows the guild's master volume, or sets it for members who can manage the server
+func handleMasterVolume(req *commandRequest) error {
+	if len(req.Args) == 0 {
+		return req.Reply("Master volume is " + formatVolume(req.gState.Settings().Volume))
+	}
+
+	volume, err := parseVolume(req.Args[0])
+	if err != nil {
+		return err
+	}
+	if !canManageGuild(req.d, req.User.ID, req.gState) {
+		return userErrorf("Only members who can manage the server can change the master volume")
+	}
+
+	settings, err := setMasterVolume(req.d, req.GuildID, req.gState, volume)
+	if err != nil {
+		return err
+	}
+	return req.Reply("Master volume set to " + formatVolume(settings.Volume))
+}
+
+// handleMyVolume shows or sets how loud the sounds the user triggers play
+func handleMyVolume(req *commandRequest) error {
+	if len(req.Args) == 0 {
+		volume, ok := req.gState.Settings().UserVolumes[req.User.ID]
+		if !ok {
+			return req.Reply("Your sounds play at " + formatVolume(nil))
+		}
+		return req.Reply("Your sounds play at " + formatVolume(&volume))
+	}
+
+	volume, err := parseVolume(req.Args[0])
+	if err != nil {
+		return err
+	}
+
+	_, err = setUserVolume(req.d, req.GuildID, req.gState, req.User.ID, volume)
+	if err != nil {
+		return err
+	}
+	return req.Reply("Your sounds now play at " + formatVolume(volume))
+}
+
+func (a *api) getSettings(w http.ResponseWriter, r *http.Request) {
+	gState, err := loadedGuild(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, gState.Settings().public())
+}
+
+// updateSettings sets the master volume (in percent, null unsets it), only for members who can manage the server
+func (a *api) updateSettings(w http.ResponseWriter, r *http.Request) {
+	guildID := r.PathValue("id")
+	gState, err := loadedGuild(guildID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if !canManageGuild(a.d, callerFrom(r.Context()).UserID, gState) {
+		writeError(w, r, &userError{msg: "Only members who can manage the server can change settings", cause: errForbidden})
+		return
+	}
+
+	volume, ok := readVolume(w, r)
+	if !ok {
+		return
+	}
+
+	settings, err := setMasterVolume(a.d, guildID, gState, volume)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, settings.public())
+}
+
+// setUserVolume sets how loud the sounds a user triggers play (in percent, null unsets it), users can only set their own
+func (a *api) setUserVolume(w http.ResponseWriter, r *http.Request) {
+	guildID := r.PathValue("id")
+	gState, err := loadedGuild(guildID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	userID := r.PathValue("userID")
+	if callerFrom(r.Context()).UserID != userID {
+		writeError(w, r, &userError{msg: "You can only set your own volume", cause: errForbidden})
+		return
+	}
+
+	volume, ok := readVolume(w, r)
+	if !ok {
+		return
+	}
+
+	settings, err := setUserVolume(a.d, guildID, gState, userID, volume)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, settings.public())
+}
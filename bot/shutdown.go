@@ -0,0 +1,74 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// shutdownTimeout is how long shutdown waits on players and in-flight HTTP requests
+const shutdownTimeout = 10 * time.Second
+
+// shuttingDown is closed when shutdown starts, nothing new gets queued or reconciled after that
+var shuttingDown = make(chan struct{})
+
+func isShuttingDown() bool {
+	select {
+	case <-shuttingDown:
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdown stops taking commands, stops every guild's player, leaves voice, closes the session
+// and then gives the HTTP server until shutdownTimeout to finish its requests
+func shutdown(d *discordgo.Session, server *http.Server) {
+	close(shuttingDown)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	for _, guildID := range store.GuildIDs() {
+		gState, ok := store.Guild(guildID)
+		if !ok {
+			continue
+		}
+
+		gState.Queue.Close()
+		select {
+		case <-gState.Queue.Done():
+		case <-ctx.Done():
+			slog.Warn("player didn't stop in time", "guild", guildID)
+		}
+	}
+
+	d.RLock()
+	voiceConnections := make([]*discordgo.VoiceConnection, 0, len(d.VoiceConnections))
+	for _, v := range d.VoiceConnections {
+		voiceConnections = append(voiceConnections, v)
+	}
+	d.RUnlock()
+
+	for _, v := range voiceConnections {
+		err := v.Disconnect()
+		if err != nil {
+			logError("disconnecting voice", err, "guild", v.GuildID)
+		}
+	}
+
+	err := d.Close()
+	if err != nil {
+		logError("closing session", err)
+	}
+
+	err = server.Shutdown(ctx)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logError("shutting down http server", err)
+	}
+	slog.Info("shutdown complete")
+}
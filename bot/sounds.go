@@ -0,0 +1,232 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// the operations below (and the settings ones in settings.go) are shared by the comma/slash commands and the HTTP API,
+// each one writes to the backend first and only touches the GuildState once that worked
+
+// validSoundName is true for names that can be used as a command argument
+func validSoundName(name string) bool {
+	return name != "" && len(name) <= 100 && !strings.ContainsAny(name, " \t\n/")
+}
+
+// addSound lists an uploaded sound, its message is already in the sounds channel
+func addSound(d *discordgo.Session, guildID string, gState *GuildState, name string, sound *Sound) error {
+	err := backend.AddSound(d, guildID, name, sound)
+	if err != nil {
+		return failed("Error saving sound", err)
+	}
+
+	gState.AddSound(name, sound)
+	frames.warm(d, gState, sound)
+	return nil
+}
+
+func renameSound(d *discordgo.Session, guildID string, gState *GuildState, name string, newName string) (*Sound, error) {
+	err := checkRename(gState, name, newName)
+	if err != nil {
+		return nil, err
+	}
+
+	updatedSound, err := backend.RenameSound(d, guildID, name, newName)
+	if err != nil {
+		return nil, failed("Error renaming sound", err)
+	}
+
+	gState.ReplaceSound(name, newName, updatedSound)
+	return updatedSound, nil
+}
+
+// checkRename is what renameSound checks before changing anything, for callers that make other changes first
+func checkRename(gState *GuildState, name string, newName string) error {
+	if !validSoundName(newName) {
+		return userErrorf("Sound names can't be empty or have spaces or slashes")
+	}
+	if _, ok := gState.Sound(name); !ok {
+		return fmt.Errorf("%w: %q", errSoundNotFound, name)
+	}
+	if _, exists := gState.Sound(newName); exists {
+		return &userError{msg: "There's already a sound called " + newName, cause: errSoundExists}
+	}
+	return nil
+}
+
+// checkVolume is what setSoundVolume checks before changing anything
+func checkVolume(volume *int) error {
+	if volume != nil && (*volume < 0 || *volume > maxVolume) {
+		return userErrorf("Volume must be between 0 and %d%%", maxVolume)
+	}
+	return nil
+}
+
+// setSoundVolume sets a sound's volume in percent, nil unsets it so it plays at defaultVolume
+func setSoundVolume(d *discordgo.Session, guildID string, gState *GuildState, name string, volume *int) (*Sound, error) {
+	if err := checkVolume(volume); err != nil {
+		return nil, err
+	}
+	if _, ok := gState.Sound(name); !ok {
+		return nil, fmt.Errorf("%w: %q", errSoundNotFound, name)
+	}
+
+	updatedSound, err := backend.SetVolume(d, guildID, name, volume)
+	if err != nil {
+		return nil, failed("Error adjusting volume", err)
+	}
+
+	// the frames cached at the old volume have another key, they're left for the LRU (see framecache.go)
+	gState.ReplaceSound(name, name, updatedSound)
+	frames.warm(d, gState, updatedSound)
+	return updatedSound, nil
+}
+
+// setSoundLoudness stores a sound's measured loudness, messageID makes sure it's still the file that was measured
+func setSoundLoudness(d *discordgo.Session, guildID string, gState *GuildState, name string, messageID string, info audioInfo) (*Sound, error) {
+	sound, ok := gState.Sound(name)
+	if !ok || sound.MessageID != messageID {
+		return nil, fmt.Errorf("%w: %q", errSoundNotFound, name)
+	}
+
+	updatedSound, err := backend.SetLoudness(d, guildID, name, info.Loudness, info.Peak)
+	if err != nil {
+		return nil, failed("Error saving loudness", err)
+	}
+
+	gState.ReplaceSound(name, name, updatedSound)
+	return updatedSound, nil
+}
+
+// replaceSoundFile swaps a sound's file for file (an edit of it), edited describes the new file.
+// the sound keeps its name, volume and entrances, messageID makes sure it's still the file that was edited
+func replaceSoundFile(d *discordgo.Session, guildID string, gState *GuildState, name string, messageID string, edited *Sound, file io.Reader) (*Sound, error) {
+	sound, ok := gState.Sound(name)
+	if !ok || sound.MessageID != messageID {
+		return nil, fmt.Errorf("%w: %q", errSoundNotFound, name)
+	}
+
+	_, updatedSound, err := uploadSoundFile(d, guildID, edited, name, "", file)
+	if err != nil {
+		return nil, failed("Error uploading the edited sound", err)
+	}
+	// the sound is now another message, saving it under the same name points the store at it
+	err = backend.AddSound(d, guildID, name, updatedSound)
+	if err != nil {
+		return nil, failed("Error saving sound", err)
+	}
+
+	gState.ReplaceSound(name, name, updatedSound)
+	frames.warm(d, gState, updatedSound)
+	return updatedSound, nil
+}
+
+func setEntrance(d *discordgo.Session, guildID string, gState *GuildState, userID string, name string) (*Sound, error) {
+	sound, ok := gState.Sound(name)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", errSoundNotFound, name)
+	}
+	if userEntrance, _ := gState.Entrance(userID); userEntrance == sound {
+		return nil, errAlreadyEntrance
+	}
+
+	updatedSound, err := backend.SetEntrance(d, guildID, userID, name)
+	if err != nil {
+		if errors.Is(err, errAlreadyEntrance) {
+			return nil, err
+		}
+		return nil, failed("Error setting entrance", err)
+	}
+
+	gState.ReplaceSound(name, name, updatedSound)
+	gState.SetEntrance(userID, updatedSound)
+	return updatedSound, nil
+}
+
+// deleteSound deletes the sound's message, its delete event is expected so it doesn't remove anything.
+// The other sounds of an upload of several files get messages of their own first, they'd go with it otherwise
+func deleteSound(d *discordgo.Session, guildID string, gState *GuildState, name string) error {
+	sound, ok := gState.Sound(name)
+	if !ok {
+		return fmt.Errorf("%w: %q", errSoundNotFound, name)
+	}
+
+	for siblingName, sibling := range gState.Sounds() {
+		if sibling.MessageID != sound.MessageID || siblingName == name {
+			continue
+		}
+		err := moveSoundFile(d, guildID, gState, siblingName, sibling)
+		if err != nil {
+			return failed("Error keeping "+siblingName+", which was uploaded with "+name, err)
+		}
+	}
+
+	expectDelete(sound.MessageID)
+	err := d.ChannelMessageDelete(gState.SoundsChannelID(), sound.MessageID)
+	if err != nil {
+		expectedDeletes.Delete(sound.MessageID)
+		return failed("Error deleting sound", err)
+	}
+	return unlistSound(guildID, gState, name, sound)
+}
+
+// unlistSound forgets a sound and leaves its message alone, for a message that still has another sound's file
+func unlistSound(guildID string, gState *GuildState, name string, sound *Sound) error {
+	err := backend.DeleteSound(guildID, name)
+	if err != nil {
+		return failed("Error deleting sound", err)
+	}
+
+	gState.RemoveSound(name)
+	forgetSoundFile(sound)
+	return nil
+}
+
+// forgetSoundFile drops what's cached about a file that's gone or replaced, its frames and hash
+func forgetSoundFile(sound *Sound) {
+	frames.invalidate(sound.fileID())
+	soundHashes.Delete(sound.fileID())
+}
+
+// moveSoundFile re-uploads a sound into a message of its own, the message it shares with other sounds stays
+func moveSoundFile(d *discordgo.Session, guildID string, gState *GuildState, name string, sound *Sound) error {
+	_, updatedSound, err := reuploadSound(d, guildID, sound, name, "")
+	if err != nil {
+		return err
+	}
+	// the sound is now another message, saving it under the same name points the store at it
+	err = backend.AddSound(d, guildID, name, updatedSound)
+	if err != nil {
+		return err
+	}
+
+	gState.ReplaceSound(name, name, updatedSound)
+	return nil
+}
+
+// queueSound adds a sound to the guild's queue and returns the queued item (with its ID) and its position
+func queueSound(gState *GuildState, name string, channelID string, userID string) (*QueueItem, int, error) {
+	sound, ok := gState.Sound(name)
+	if !ok {
+		return nil, 0, fmt.Errorf("%w: %q", errSoundNotFound, name)
+	}
+	if channelID == "" {
+		return nil, 0, userErrorf("You need to be in a voice channel")
+	}
+
+	item := &QueueItem{
+		Name:        name,
+		Sound:       sound,
+		ChannelID:   channelID,
+		RequestedBy: userID,
+	}
+	pos := gState.Queue.Enqueue(item)
+	if pos == 0 {
+		return nil, 0, userErrorf("The bot is restarting, try again in a bit")
+	}
+	return item, pos, nil
+}
@@ -0,0 +1,431 @@
+package bot
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Locking model:
+//   - GlobalStore.mu guards the map of guilds, GuildState.mu guards everything inside one guild
+//   - neither lock is held while talking to discord or the backend, read what's needed, do the slow part, then write
+//   - a *Sound is never modified once it's in a SoundList, changes swap in a new *Sound (see ReplaceSound),
+//     so it's safe to keep using one after the lock is released
+//   - maps and slices returned by accessors are copies
+//   - mutators publish their Event while still holding the lock so subscribers see changes in order, the hub never calls back
+//   - GuildState.settingsMu is held through a whole read, change and save of the settings (see updateSettings),
+//     it's never taken while holding mu
+
+// GlobalStore Store [guildID]
+type GlobalStore struct {
+	mu     sync.RWMutex
+	guilds map[string]*GuildState
+}
+
+func newGlobalStore() *GlobalStore {
+	return &GlobalStore{guilds: make(map[string]*GuildState)}
+}
+
+func (s *GlobalStore) Guild(guildID string) (*GuildState, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	gState, ok := s.guilds[guildID]
+	return gState, ok
+}
+
+func (s *GlobalStore) GuildIDs() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	guildIDs := make([]string, 0, len(s.guilds))
+	for guildID := range s.guilds {
+		guildIDs = append(guildIDs, guildID)
+	}
+	return guildIDs
+}
+
+// Replace swaps every guild at once, used when the store is (re)built
+func (s *GlobalStore) Replace(guilds map[string]*GuildState) {
+	s.mu.Lock()
+	s.guilds = guilds
+	s.mu.Unlock()
+}
+
+type GuildState struct {
+	guildID         string
+	mu              sync.RWMutex
+	soundList       SoundList
+	entrances       Entrances
+	channels        Channels
+	soundsChannelID string
+	settings        GuildSettings
+	settingsMu      sync.Mutex
+	// generation counts the changes to the sounds and entrances, see ReplaceSounds
+	generation uint64
+	// Queue is set once when the guild is loaded, it does its own locking
+	Queue *PlaybackQueue
+}
+
+func newGuildState(guildID string, soundsChannelID string, sList SoundList, entrances Entrances, settings GuildSettings, queue *PlaybackQueue) *GuildState {
+	return &GuildState{
+		guildID:         guildID,
+		soundList:       sList,
+		entrances:       entrances,
+		soundsChannelID: soundsChannelID,
+		settings:        settings.clone(),
+		channels: Channels{
+			VoiceChannels: []VoiceChannel{},
+		},
+		Queue: queue,
+	}
+}
+
+func (g *GuildState) Sound(name string) (*Sound, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	sound, ok := g.soundList[name]
+	return sound, ok
+}
+
+// Sounds returns a copy of the sound list
+func (g *GuildState) Sounds() SoundList {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	sList := make(SoundList, len(g.soundList))
+	for name, sound := range g.soundList {
+		sList[name] = sound
+	}
+	return sList
+}
+
+// SoundNames returns every sound name, sorted
+func (g *GuildState) SoundNames() []string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	names := make([]string, 0, len(g.soundList))
+	for name := range g.soundList {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (g *GuildState) SoundCount() int {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return len(g.soundList)
+}
+
+// SoundName finds the name a sound is listed under, sounds don't know their own name
+func (g *GuildState) SoundName(sound *Sound) (string, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return findSoundName(g.soundList, sound)
+}
+
+func findSoundName(sList SoundList, sound *Sound) (string, bool) {
+	for name, s := range sList {
+		if s == sound {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// SoundsInMessage returns the sounds whose file is in messageID, an upload can have several
+func (g *GuildState) SoundsInMessage(messageID string) SoundList {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	sList := make(SoundList)
+	for name, sound := range g.soundList {
+		if sound.MessageID == messageID {
+			sList[name] = sound
+		}
+	}
+	return sList
+}
+
+func (g *GuildState) AddSound(name string, sound *Sound) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.soundList[name] = sound
+	g.generation++
+	events.Publish(g.guildID, EventSoundAdd, soundEvent{Name: name, Sound: sound})
+}
+
+// ReplaceSound swaps the sound listed as name for updated (listed as newName), entrances follow it
+func (g *GuildState) ReplaceSound(name string, newName string, updated *Sound) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	old := g.soundList[name]
+	delete(g.soundList, name)
+	g.soundList[newName] = updated
+	g.generation++
+
+	for userID, entrance := range g.entrances {
+		if entrance == old {
+			g.entrances[userID] = updated
+		}
+	}
+
+	if name != newName {
+		events.Publish(g.guildID, EventSoundRename, soundEvent{Name: name, NewName: newName, Sound: updated})
+	} else {
+		events.Publish(g.guildID, EventSoundUpdate, soundEvent{Name: name, Sound: updated})
+	}
+}
+
+// RemoveSound drops a sound and any entrance using it, returns nil if there was no such sound
+func (g *GuildState) RemoveSound(name string) *Sound {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	sound, ok := g.soundList[name]
+	if !ok {
+		return nil
+	}
+
+	delete(g.soundList, name)
+	for userID, entrance := range g.entrances {
+		if entrance == sound {
+			delete(g.entrances, userID)
+		}
+	}
+	g.generation++
+
+	events.Publish(g.guildID, EventSoundDelete, soundEvent{Name: name})
+	return sound
+}
+
+// Generation changes whenever a sound or entrance does, a new URL (SetSoundURL) doesn't count
+func (g *GuildState) Generation() uint64 {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return g.generation
+}
+
+// ReplaceSounds swaps the whole sound list and entrances in one go and returns the previous sound list,
+// unless something changed since generation (the list was read before it), then it returns false and changes nothing
+func (g *GuildState) ReplaceSounds(sList SoundList, entrances Entrances, generation uint64) (SoundList, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.generation != generation {
+		return nil, false
+	}
+	previous := g.soundList
+	g.soundList, g.entrances = sList, entrances
+	g.generation++
+
+	events.Publish(g.guildID, EventSoundsReload, struct {
+		Count int `json:"count"`
+	}{len(sList)})
+	return previous, true
+}
+
+// UpdateSound swaps in updated for name and makes it the entrance of exactly the users in entranceUserIDs
+func (g *GuildState) UpdateSound(name string, updated *Sound, entranceUserIDs []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	old := g.soundList[name]
+	g.soundList[name] = updated
+	g.generation++
+
+	for userID, entrance := range g.entrances {
+		if entrance == old {
+			delete(g.entrances, userID)
+		}
+	}
+	for _, userID := range entranceUserIDs {
+		g.entrances[userID] = updated
+	}
+
+	events.Publish(g.guildID, EventSoundUpdate, soundEvent{Name: name, Sound: updated})
+}
+
+// SetSoundURL swaps the sound in messageID for a copy with url (entrances follow it), returns nil if there's no such sound.
+// A message can have several sounds, it's the one whose URL has the same attachment ID as url
+func (g *GuildState) SetSoundURL(messageID string, url string) *Sound {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var name string
+	var old *Sound
+	id := attachmentID(url)
+	for n, sound := range g.soundList {
+		if sound.MessageID == messageID && attachmentID(sound.URL) == id {
+			name, old = n, sound
+			break
+		}
+	}
+	if old == nil {
+		return nil
+	}
+	updated := *old
+	updated.URL = url
+	g.soundList[name] = &updated
+
+	for userID, entrance := range g.entrances {
+		if entrance == old {
+			g.entrances[userID] = &updated
+		}
+	}
+
+	events.Publish(g.guildID, EventSoundUpdate, soundEvent{Name: name, Sound: &updated})
+	return &updated
+}
+
+func (g *GuildState) Entrance(userID string) (*Sound, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	sound, ok := g.entrances[userID]
+	return sound, ok
+}
+
+// EntranceNames returns [UserID] -> SoundName
+func (g *GuildState) EntranceNames() map[string]string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	names := make(map[string]string, len(g.entrances))
+	for userID, sound := range g.entrances {
+		if name, ok := findSoundName(g.soundList, sound); ok {
+			names[userID] = name
+		}
+	}
+	return names
+}
+
+func (g *GuildState) SetEntrance(userID string, sound *Sound) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.entrances[userID] = sound
+	g.generation++
+	name, _ := findSoundName(g.soundList, sound)
+	events.Publish(g.guildID, EventEntranceUpdate, entranceEvent{UserID: userID, Name: name})
+}
+
+// Settings returns a copy of the guild's settings
+func (g *GuildState) Settings() GuildSettings {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return g.settings.clone()
+}
+
+func (g *GuildState) SetSettings(settings GuildSettings) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.settings = settings.clone()
+	events.Publish(g.guildID, EventSettingsUpdate, g.settings.clone().public())
+}
+
+func (g *GuildState) SoundsChannelID() string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return g.soundsChannelID
+}
+
+func (g *GuildState) SetSoundsChannelID(channelID string) {
+	g.mu.Lock()
+	g.soundsChannelID = channelID
+	g.mu.Unlock()
+}
+
+// VoiceChannels returns a copy of the guild's voice channels and who's in them
+func (g *GuildState) VoiceChannels() []VoiceChannel {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return copyVoiceChannels(g.channels.VoiceChannels)
+}
+
+func (g *GuildState) SetVoiceChannels(voiceChannels []VoiceChannel) {
+	g.mu.Lock()
+	g.channels.VoiceChannels = voiceChannels
+	g.mu.Unlock()
+}
+
+// MoveUser takes a user out of whatever voice channel they were in and puts them in channelID,
+// an empty channelID (or a nil user) means they left voice
+func (g *GuildState) MoveUser(userID string, channelID string, user *discordgo.User) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	previousChannelID := ""
+	for idx, vc := range g.channels.VoiceChannels {
+		for i, u := range vc.UsersConnected {
+			if u.ID == userID {
+				g.channels.VoiceChannels[idx].UsersConnected = append(vc.UsersConnected[:i:i], vc.UsersConnected[i+1:]...)
+				previousChannelID = vc.ID
+				break
+			}
+		}
+	}
+
+	if user == nil {
+		channelID = ""
+	}
+	// a mute or deafen is also a voice state update, staying in the same channel isn't an event
+	if previousChannelID != "" && previousChannelID != channelID {
+		events.Publish(g.guildID, EventVoiceLeave, voiceEvent{UserID: userID, ChannelID: previousChannelID})
+	}
+
+	if channelID == "" {
+		return
+	}
+
+	for idx, vc := range g.channels.VoiceChannels {
+		if vc.ID == channelID {
+			g.channels.VoiceChannels[idx].UsersConnected = append(vc.UsersConnected, *user)
+			if previousChannelID != channelID {
+				events.Publish(g.guildID, EventVoiceJoin, voiceEvent{UserID: userID, Username: user.Username, ChannelID: channelID})
+			}
+			return
+		}
+	}
+}
+
+// MarshalJSON keeps the shape the HTTP API has always returned
+func (g *GuildState) MarshalJSON() ([]byte, error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return json.Marshal(struct {
+		SoundList       SoundList `json:"soundList"`
+		Entrances       Entrances `json:"entrances"`
+		Channels        Channels  `json:"channels"`
+		SoundsChannelID string    `json:"soundsChannelID"`
+	}{
+		SoundList:       g.soundList,
+		Entrances:       g.entrances,
+		Channels:        g.channels,
+		SoundsChannelID: g.soundsChannelID,
+	})
+}
+
+func copyVoiceChannels(voiceChannels []VoiceChannel) []VoiceChannel {
+	copied := make([]VoiceChannel, len(voiceChannels))
+	for i, vc := range voiceChannels {
+		copied[i] = vc
+		copied[i].UsersConnected = append([]discordgo.User{}, vc.UsersConnected...)
+	}
+	return copied
+}
@@ -0,0 +1,244 @@
+package bot
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// these are meant for go test -race, they mostly check that nothing touches a guild without its lock
+
+const testGuildID = "guild"
+
+func newTestGuild(t *testing.T, sounds int) *GuildState {
+	t.Helper()
+
+	sList := make(SoundList)
+	entrances := make(Entrances)
+	for i := 0; i < sounds; i++ {
+		sound := &Sound{MessageID: "m" + strconv.Itoa(i), URL: "https://cdn.example/" + strconv.Itoa(i)}
+		sList["sound"+strconv.Itoa(i)] = sound
+		entrances["user"+strconv.Itoa(i)] = sound
+	}
+	gState := newGuildState(testGuildID, "sounds", sList, entrances, GuildSettings{}, newPlaybackQueue(testGuildID))
+
+	previous := store
+	store = newGlobalStore()
+	store.Replace(map[string]*GuildState{testGuildID: gState})
+	t.Cleanup(func() { store = previous })
+	return gState
+}
+
+// parallel runs every fn n times, each in its own goroutine, and waits for all of them
+func parallel(n int, fns ...func(i int)) {
+	var wg sync.WaitGroup
+	for _, fn := range fns {
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(fn func(int), i int) {
+				defer wg.Done()
+				fn(i)
+			}(fn, i)
+		}
+	}
+	wg.Wait()
+}
+
+func TestGuildStateConcurrentSounds(t *testing.T) {
+	gState := newTestGuild(t, 20)
+
+	parallel(50,
+		// uploads
+		func(i int) {
+			gState.AddSound("new"+strconv.Itoa(i), &Sound{MessageID: "n" + strconv.Itoa(i)})
+		},
+		// renames and volume changes
+		func(i int) {
+			name := "sound" + strconv.Itoa(i%20)
+			if sound, ok := gState.Sound(name); ok {
+				updated := *sound
+				volume := i
+				updated.Volume = &volume
+				gState.ReplaceSound(name, name, &updated)
+			}
+		},
+		// deletes
+		func(i int) {
+			if i%5 == 0 {
+				gState.RemoveSound("sound" + strconv.Itoa(i%20))
+			}
+		},
+		// refreshed URLs
+		func(i int) {
+			gState.SetSoundURL("m"+strconv.Itoa(i%20), "https://cdn.example/fresh/"+strconv.Itoa(i))
+		},
+		// entrances
+		func(i int) {
+			if sound, ok := gState.Sound("sound" + strconv.Itoa(i%20)); ok {
+				gState.SetEntrance("user"+strconv.Itoa(i), sound)
+			}
+		},
+		// plays read the sound and entrance, then use them without the lock
+		func(i int) {
+			if sound, ok := gState.Sound("sound" + strconv.Itoa(i%20)); ok {
+				_ = sound.URL + sound.MessageID
+				_ = sound.volume()
+			}
+			if sound, ok := gState.Entrance("user" + strconv.Itoa(i%20)); ok {
+				_ = sound.URL
+			}
+		},
+		func(int) {
+			for name, sound := range gState.Sounds() {
+				_ = name + sound.URL
+			}
+			_ = gState.SoundNames()
+			_ = gState.SoundCount()
+			_ = gState.EntranceNames()
+		},
+	)
+
+	for userID, name := range gState.EntranceNames() {
+		if _, ok := gState.Sound(name); !ok {
+			t.Errorf("entrance of %s is %q, which isn't a sound", userID, name)
+		}
+	}
+	for i := 0; i < 50; i++ {
+		if _, ok := gState.Sound("new" + strconv.Itoa(i)); !ok {
+			t.Errorf("upload new%d got lost", i)
+		}
+	}
+}
+
+func TestGuildStateConcurrentSettings(t *testing.T) {
+	gState := newTestGuild(t, 1)
+
+	parallel(50,
+		func(i int) {
+			settings := gState.Settings()
+			settings.UserVolumes["user"+strconv.Itoa(i)] = i
+			gState.SetSettings(settings)
+		},
+		func(i int) {
+			// the returned settings are a copy, changing them can't race with other readers
+			settings := gState.Settings()
+			settings.UserVolumes["mine"] = i
+			_ = settings.volumeScale("user" + strconv.Itoa(i))
+		},
+	)
+
+	if _, ok := gState.Settings().UserVolumes["mine"]; ok {
+		t.Error("changing a copy of the settings changed the guild's")
+	}
+}
+
+func TestGuildStateConcurrentHTTPReads(t *testing.T) {
+	gState := newTestGuild(t, 20)
+	a := &api{}
+
+	get := func(handler http.HandlerFunc, path string, values map[string]string) int {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		for key, value := range values {
+			r.SetPathValue(key, value)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	parallel(30,
+		func(i int) {
+			gState.AddSound("new"+strconv.Itoa(i), &Sound{MessageID: "n" + strconv.Itoa(i)})
+			gState.RemoveSound("sound" + strconv.Itoa(i%20))
+		},
+		func(i int) {
+			gState.MoveUser("user"+strconv.Itoa(i), "voice", nil)
+		},
+		func(int) {
+			if code := get(a.listSounds, "/api/v1/guilds/guild/sounds", map[string]string{"id": testGuildID}); code != http.StatusOK {
+				t.Errorf("listing sounds: %d", code)
+			}
+		},
+		func(int) {
+			if code := get(a.listEntrances, "/api/v1/guilds/guild/entrances", map[string]string{"id": testGuildID}); code != http.StatusOK {
+				t.Errorf("listing entrances: %d", code)
+			}
+		},
+		func(int) {
+			if code := get(a.getSettings, "/api/v1/guilds/guild/settings", map[string]string{"id": testGuildID}); code != http.StatusOK {
+				t.Errorf("getting settings: %d", code)
+			}
+		},
+		func(int) {
+			if code := get(handleSoundList, "/?guildID=guild", nil); code != http.StatusOK {
+				t.Errorf("getting the guild: %d", code)
+			}
+			_, err := json.Marshal(gState)
+			if err != nil {
+				t.Errorf("marshaling the guild: %v", err)
+			}
+		},
+	)
+}
+
+func TestGlobalStoreConcurrent(t *testing.T) {
+	newTestGuild(t, 1)
+
+	parallel(30,
+		func(i int) {
+			guilds := make(map[string]*GuildState)
+			for _, guildID := range store.GuildIDs() {
+				gState, _ := store.Guild(guildID)
+				guilds[guildID] = gState
+			}
+			guildID := "guild" + strconv.Itoa(i)
+			guilds[guildID] = newGuildState(guildID, "", make(SoundList), make(Entrances), GuildSettings{}, nil)
+			store.Replace(guilds)
+		},
+		func(int) {
+			if _, err := loadedGuild(testGuildID); err != nil {
+				t.Errorf("the guild disappeared during rebuilds: %v", err)
+			}
+		},
+	)
+}
+
+func TestReplaceSoundsKeepsNewerChanges(t *testing.T) {
+	gState := newTestGuild(t, 2)
+
+	generation := gState.Generation()
+	gState.AddSound("uploaded", &Sound{MessageID: "u"})
+	if _, ok := gState.ReplaceSounds(make(SoundList), make(Entrances), generation); ok {
+		t.Fatal("a list read before an upload replaced the guild's sounds")
+	}
+	if _, ok := gState.Sound("uploaded"); !ok {
+		t.Fatal("the upload got lost")
+	}
+
+	gState.SetSoundURL("m0", "https://cdn.example/fresh")
+	previous, ok := gState.ReplaceSounds(SoundList{"reconciled": {MessageID: "r"}}, make(Entrances), gState.Generation())
+	if !ok || len(previous) != 3 {
+		t.Fatalf("ReplaceSounds = %d sounds, %v, want the 3 sounds from before", len(previous), ok)
+	}
+	if names := gState.SoundNames(); len(names) != 1 || names[0] != "reconciled" {
+		t.Errorf("sounds after reconciling = %v", names)
+	}
+}
+
+func TestSetSoundURLPicksTheAttachment(t *testing.T) {
+	gState := newTestGuild(t, 0)
+	gState.AddSound("first", &Sound{MessageID: "m", URL: "https://cdn.discordapp.com/attachments/c/a1/first.mp3?ex=1"})
+	gState.AddSound("second", &Sound{MessageID: "m", URL: "https://cdn.discordapp.com/attachments/c/a2/second.mp3?ex=1"})
+
+	gState.SetSoundURL("m", "https://cdn.discordapp.com/attachments/c/a2/second.mp3?ex=2")
+
+	if first, _ := gState.Sound("first"); first.URL != "https://cdn.discordapp.com/attachments/c/a1/first.mp3?ex=1" {
+		t.Errorf("first got the second's URL: %s", first.URL)
+	}
+	if second, _ := gState.Sound("second"); second.URL != "https://cdn.discordapp.com/attachments/c/a2/second.mp3?ex=2" {
+		t.Errorf("second kept its old URL: %s", second.URL)
+	}
+}
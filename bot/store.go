@@ -0,0 +1,348 @@
+package bot
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/cgoncalveslck/go-api-ebening/bot/metadata"
+)
+
+var backend Store
+
+// Store persists what's in a GuildState, the files themselves always live in the guild's sounds channel
+// implementations don't touch the in-memory store, callers apply the returned sounds with GuildState.ReplaceSound
+type Store interface {
+	// Load returns every sound and entrance for a guild
+	Load(d *discordgo.Session, guildID string, soundsChannelID string) (SoundList, Entrances, error)
+	// Reconcile checks the store against the sounds channel and returns the guild as it should be now
+	Reconcile(d *discordgo.Session, guildID string, soundsChannelID string) (SoundList, Entrances, error)
+	// AddSound saves a sound that was just uploaded to the sounds channel
+	AddSound(d *discordgo.Session, guildID string, name string, sound *Sound) error
+	// DeleteSound forgets a sound whose message was deleted
+	DeleteSound(guildID string, name string) error
+	RenameSound(d *discordgo.Session, guildID string, name string, newName string) (*Sound, error)
+	// SetVolume sets a sound's volume in percent, nil unsets it
+	SetVolume(d *discordgo.Session, guildID string, name string, volume *int) (*Sound, error)
+	// SetLoudness saves a sound's measured loudness (LUFS) and true peak (dBTP)
+	SetLoudness(d *discordgo.Session, guildID string, name string, loudness float64, peak float64) (*Sound, error)
+	// SetEntrance makes a sound the user's entrance, replacing the one they had, returns errAlreadyEntrance if nothing changed
+	SetEntrance(d *discordgo.Session, guildID string, userID string, name string) (*Sound, error)
+	// LoadSettings returns the guild's settings, a guild that never saved any has the zero GuildSettings
+	LoadSettings(d *discordgo.Session, guildID string, soundsChannelID string) (GuildSettings, error)
+	SaveSettings(d *discordgo.Session, guildID string, settings GuildSettings) error
+	Close() error
+}
+
+func openStore() (Store, error) {
+	switch config.StoreBackend {
+	case "discord":
+		return &discordStore{}, nil
+	case "bolt":
+		return openBoltStore(config.StorePath)
+	default:
+		return nil, fmt.Errorf("unknown store backend %q", config.StoreBackend)
+	}
+}
+
+func loadedGuild(guildID string) (*GuildState, error) {
+	gState, ok := store.Guild(guildID)
+	if !ok {
+		return nil, fmt.Errorf("guild %s: %w", guildID, errGuildNotLoaded)
+	}
+	return gState, nil
+}
+
+// discordStore keeps metadata in the content of each sound's message in the sounds channel
+type discordStore struct{}
+
+func (s *discordStore) Load(d *discordgo.Session, guildID string, soundsChannelID string) (SoundList, Entrances, error) {
+	sList := make(SoundList)
+	entrances := make(Entrances)
+	migrations := make(map[string]metadata.Metadata)
+	err := getSoundsRecursive(d, soundsChannelID, "", sList, entrances, migrations)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(migrations) > 0 {
+		go migrateMetadata(d, soundsChannelID, migrations)
+	}
+	if gState, ok := store.Guild(guildID); ok {
+		keepMeasurements(gState, sList)
+	}
+	return sList, entrances, nil
+}
+
+// keepMeasurements copies what was measured about the loaded sounds (loudness, hash) from the ones gState has for
+// the same file. A user upload's loudness only lives in memory (see SetLoudness), without this every reload would
+// measure it again and play it from a different cache entry
+func keepMeasurements(gState *GuildState, sList SoundList) {
+	current := gState.Sounds()
+	byFile := make(map[string]*Sound, len(current))
+	for _, sound := range current {
+		byFile[sound.fileID()] = sound
+	}
+
+	// the loaded sounds aren't shared with anything yet, they can still be changed
+	for _, sound := range sList {
+		previous, ok := byFile[sound.fileID()]
+		if !ok {
+			continue
+		}
+		if sound.Loudness == 0 && previous.Loudness != 0 {
+			sound.Loudness = previous.Loudness
+			sound.Peak = previous.Peak
+		}
+		if sound.Hash == "" {
+			sound.Hash = previous.Hash
+		}
+	}
+}
+
+// Reconcile is a full load, the channel is the store (measurements that only live in memory are kept, see keepMeasurements)
+func (s *discordStore) Reconcile(d *discordgo.Session, guildID string, soundsChannelID string) (SoundList, Entrances, error) {
+	return s.Load(d, guildID, soundsChannelID)
+}
+
+// AddSound has nothing to do, the upload is already in the channel
+func (s *discordStore) AddSound(*discordgo.Session, string, string, *Sound) error {
+	return nil
+}
+
+// DeleteSound has nothing to do, the message is already gone
+func (s *discordStore) DeleteSound(string, string) error {
+	return nil
+}
+
+func (s *discordStore) RenameSound(d *discordgo.Session, guildID string, name string, newName string) (*Sound, error) {
+	gState, err := loadedGuild(guildID)
+	if err != nil {
+		return nil, err
+	}
+
+	sound, ok := gState.Sound(name)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", errSoundNotFound, name)
+	}
+
+	// find file by name, upload it with new name, delete old file
+	_, updatedSound, err := reuploadSound(d, guildID, sound, name, newName)
+	return updatedSound, err
+}
+
+func (s *discordStore) SetVolume(d *discordgo.Session, guildID string, name string, volume *int) (*Sound, error) {
+	soundMessage, sound, err := s.editableMessage(d, guildID, name)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := metadata.Decode(soundMessage.Content)
+	if err != nil {
+		return nil, err
+	}
+	meta.Volume = volume
+	_, err = d.ChannelMessageEdit(soundMessage.ChannelID, soundMessage.ID, meta.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	updatedSound := *sound
+	updatedSound.Volume = volume
+	return &updatedSound, nil
+}
+
+// SetLoudness only writes to the bot's own messages, re-uploading every user upload just for this isn't worth it.
+// user uploads are measured again after a restart instead (see measureLater)
+func (s *discordStore) SetLoudness(d *discordgo.Session, guildID string, name string, loudness float64, peak float64) (*Sound, error) {
+	gState, err := loadedGuild(guildID)
+	if err != nil {
+		return nil, err
+	}
+
+	sound, ok := gState.Sound(name)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", errSoundNotFound, name)
+	}
+	updatedSound := *sound
+	updatedSound.Loudness = loudness
+	updatedSound.Peak = peak
+
+	soundMessage, err := d.ChannelMessage(gState.SoundsChannelID(), sound.MessageID)
+	if err != nil {
+		return nil, err
+	}
+	if soundMessage.Author.ID != d.State.User.ID {
+		return &updatedSound, nil
+	}
+
+	meta, err := metadata.Decode(soundMessage.Content)
+	if err != nil {
+		return nil, err
+	}
+	meta.Loudness = loudness
+	meta.Peak = peak
+	_, err = d.ChannelMessageEdit(soundMessage.ChannelID, soundMessage.ID, meta.Encode())
+	if err != nil {
+		return nil, err
+	}
+	return &updatedSound, nil
+}
+
+func (s *discordStore) SetEntrance(d *discordgo.Session, guildID string, userID string, name string) (*Sound, error) {
+	soundMessage, sound, err := s.editableMessage(d, guildID, name)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := metadata.Decode(soundMessage.Content)
+	if err != nil {
+		return nil, err
+	}
+	if meta.HasEntrance(userID) {
+		return sound, errAlreadyEntrance
+	}
+
+	gState, err := loadedGuild(guildID)
+	if err != nil {
+		return nil, err
+	}
+
+	userEntrance, ok := gState.Entrance(userID)
+	if ok && userEntrance.MessageID != sound.MessageID {
+		oldEntranceMessage, err := d.ChannelMessage(soundMessage.ChannelID, userEntrance.MessageID)
+		if err != nil && !strings.Contains(err.Error(), "HTTP 404") {
+			return nil, err
+		}
+
+		// remove the user from the old entrance's metadata
+		if oldEntranceMessage != nil && oldEntranceMessage.Content != "" {
+			oldMeta, err := metadata.Decode(oldEntranceMessage.Content)
+			if err != nil {
+				return nil, err
+			}
+			oldMeta.RemoveEntrance(userID)
+
+			_, err = d.ChannelMessageEdit(soundMessage.ChannelID, oldEntranceMessage.ID, oldMeta.Encode())
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	meta.AddEntrance(userID)
+	_, err = d.ChannelMessageEdit(soundMessage.ChannelID, soundMessage.ID, meta.Encode())
+	if err != nil {
+		return nil, err
+	}
+	return sound, nil
+}
+
+// LoadSettings reads the settings message the bot pinned in the sounds channel
+func (s *discordStore) LoadSettings(d *discordgo.Session, guildID string, soundsChannelID string) (GuildSettings, error) {
+	settingsMessage, err := findSettingsMessage(d, soundsChannelID)
+	if err != nil || settingsMessage == nil {
+		return GuildSettings{}, err
+	}
+
+	meta := metadata.DecodeSettings(settingsMessage.Content)
+	settings := GuildSettings{Volume: meta.Volume, UserVolumes: meta.UserVolumes, Tokens: make(map[string]apiToken, len(meta.Tokens))}
+	for tokenID, token := range meta.Tokens {
+		settings.Tokens[tokenID] = apiToken{CreatedBy: token.CreatedBy, Expires: token.Expires}
+	}
+	return settings, nil
+}
+
+// SaveSettings edits the settings message, the first save posts it and pins it so LoadSettings doesn't have to read the whole channel
+func (s *discordStore) SaveSettings(d *discordgo.Session, guildID string, settings GuildSettings) error {
+	gState, err := loadedGuild(guildID)
+	if err != nil {
+		return err
+	}
+	channelID := gState.SoundsChannelID()
+	if channelID == "" {
+		return fmt.Errorf("guild %s: %w", guildID, errNoSoundsChannel)
+	}
+
+	settingsMessage, err := findSettingsMessage(d, channelID)
+	if err != nil {
+		return err
+	}
+
+	meta := metadata.Settings{}
+	if settingsMessage != nil {
+		meta = metadata.DecodeSettings(settingsMessage.Content)
+	}
+	meta.Volume = settings.Volume
+	meta.UserVolumes = settings.UserVolumes
+	meta.Tokens = make(map[string]metadata.Token, len(settings.Tokens))
+	for tokenID, token := range settings.Tokens {
+		meta.Tokens[tokenID] = metadata.Token{CreatedBy: token.CreatedBy, Expires: token.Expires}
+	}
+	content := meta.Encode()
+	if len(content) > 2000 {
+		return userErrorf("There are too many personal volumes and tokens to keep in one message, reset or revoke some first")
+	}
+
+	if settingsMessage != nil {
+		_, err = d.ChannelMessageEdit(channelID, settingsMessage.ID, content)
+		return err
+	}
+
+	settingsMessage, err = d.ChannelMessageSend(channelID, content)
+	if err != nil {
+		return err
+	}
+	err = d.ChannelMessagePin(channelID, settingsMessage.ID)
+	if err != nil {
+		// an unpinned settings message would never be found again
+		if deleteErr := d.ChannelMessageDelete(channelID, settingsMessage.ID); deleteErr != nil {
+			logError("deleting unpinned settings message", deleteErr, "guild", guildID)
+		}
+		return fmt.Errorf("pinning settings message: %w", err)
+	}
+	return nil
+}
+
+// findSettingsMessage returns the bot's pinned settings message in the channel, nil if there's none
+func findSettingsMessage(d *discordgo.Session, channelID string) (*discordgo.Message, error) {
+	pinned, err := d.ChannelMessagesPinned(channelID)
+	if err != nil {
+		return nil, err
+	}
+	for _, message := range pinned {
+		if message.Author != nil && message.Author.ID == d.State.User.ID && metadata.IsSettings(message.Content) {
+			return message, nil
+		}
+	}
+	return nil, nil
+}
+
+// editableMessage returns the sound's message, only the bot's own messages can be edited
+// so a sound a user uploaded gets re-uploaded by the bot first
+func (s *discordStore) editableMessage(d *discordgo.Session, guildID string, name string) (*discordgo.Message, *Sound, error) {
+	gState, err := loadedGuild(guildID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sound, ok := gState.Sound(name)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %q", errSoundNotFound, name)
+	}
+
+	soundMessage, err := d.ChannelMessage(gState.SoundsChannelID(), sound.MessageID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if soundMessage.Author.ID == d.State.User.ID {
+		return soundMessage, sound, nil
+	}
+
+	return reuploadSound(d, guildID, sound, name, "")
+}
+
+func (s *discordStore) Close() error {
+	return nil
+}
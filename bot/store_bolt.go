@@ -0,0 +1,457 @@
+package bot
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/cgoncalveslck/go-api-ebening/bot/metadata"
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltStore keeps sounds and metadata in a local database, one bucket per guild with "sounds" [SoundName] and "entrances" [UserID] -> SoundName
+// metadata changes are just writes, nothing gets edited or re-uploaded in discord
+type boltStore struct {
+	db      *bolt.DB
+	discord *discordStore
+}
+
+var (
+	soundsBucket    = []byte("sounds")
+	entrancesBucket = []byte("entrances")
+	// schemaKey is the guild bucket's schema version, buckets from before it existed are version 1
+	schemaKey = []byte("schema")
+	// settingsKey is the guild's GuildSettings as JSON
+	settingsKey = []byte("settings")
+	// seededKey is set once the guild was seeded from the sounds channel, an empty guild is still seeded
+	seededKey = []byte("seeded")
+)
+
+// boltSchema 2 has volumes in percent, version 1 had them in dca's scale with 0 for unset,
+// 3 marks seeded guilds with seededKey
+const boltSchema = 3
+
+func openBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &boltStore{db: db, discord: &discordStore{}}, nil
+}
+
+// Load reads the guild from the database, the first time a guild is seen it's seeded from the sounds channel
+func (s *boltStore) Load(d *discordgo.Session, guildID string, soundsChannelID string) (SoundList, Entrances, error) {
+	sList, entrances, err := s.load(guildID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	seeded, err := s.seeded(guildID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if seeded {
+		return sList, entrances, nil
+	}
+
+	sList, entrances, err = s.discord.Load(d, guildID, soundsChannelID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sList, entrances, s.seed(guildID, sList, entrances)
+}
+
+// Reconcile matches the database with the sounds channel by file (see Sound.fileID), names, volumes and entrances
+// in the database win, sounds only in the channel get added and sounds whose message is gone get dropped
+func (s *boltStore) Reconcile(d *discordgo.Session, guildID string, soundsChannelID string) (SoundList, Entrances, error) {
+	channelSounds, channelEntrances, err := s.discord.Load(d, guildID, soundsChannelID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sList, entrances, err := s.load(guildID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	inChannel := make(map[string]*Sound, len(channelSounds))
+	for _, sound := range channelSounds {
+		inChannel[sound.fileID()] = sound
+	}
+
+	for name, sound := range sList {
+		channelSound, ok := inChannel[sound.fileID()]
+		if !ok {
+			delete(sList, name)
+			continue
+		}
+		sound.URL = channelSound.URL
+		if sound.Format == "" {
+			sound.Format = channelSound.Format
+		}
+		if sound.Size == 0 {
+			sound.Size = channelSound.Size
+		}
+		delete(inChannel, sound.fileID())
+	}
+
+	for userID, sound := range entrances {
+		if _, ok := findSoundName(sList, sound); !ok {
+			delete(entrances, userID)
+		}
+	}
+
+	for name, channelSound := range channelSounds {
+		if _, ok := inChannel[channelSound.fileID()]; !ok {
+			continue
+		}
+		if _, taken := sList[name]; taken {
+			slog.Warn("skipping sound from the sounds channel, a sound with that name already exists", "guild", guildID, "sound", name)
+			continue
+		}
+		sList[name] = channelSound
+	}
+
+	for userID, sound := range channelEntrances {
+		if _, ok := entrances[userID]; ok {
+			continue
+		}
+		if _, ok := findSoundName(sList, sound); ok {
+			entrances[userID] = sound
+		}
+	}
+
+	// the guild's settings and schema stay, only the sounds get rewritten
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		guild := tx.Bucket([]byte(guildID))
+		if guild == nil {
+			return nil
+		}
+		for _, bucket := range [][]byte{soundsBucket, entrancesBucket} {
+			if guild.Bucket(bucket) == nil {
+				continue
+			}
+			if err := guild.DeleteBucket(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return sList, entrances, s.seed(guildID, sList, entrances)
+}
+
+func (s *boltStore) load(guildID string) (SoundList, Entrances, error) {
+	sList := make(SoundList)
+	entrances := make(Entrances)
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		guild := tx.Bucket([]byte(guildID))
+		if guild == nil {
+			return nil
+		}
+		return migrateGuild(guildID, guild)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = s.db.View(func(tx *bolt.Tx) error {
+		guild := tx.Bucket([]byte(guildID))
+		if guild == nil || guild.Bucket(soundsBucket) == nil || guild.Bucket(entrancesBucket) == nil {
+			return nil
+		}
+
+		err := guild.Bucket(soundsBucket).ForEach(func(name, data []byte) error {
+			sound := &Sound{}
+			if err := json.Unmarshal(data, sound); err != nil {
+				return fmt.Errorf("sound %s: %w", name, err)
+			}
+			sList[string(name)] = sound
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return guild.Bucket(entrancesBucket).ForEach(func(userID, name []byte) error {
+			if sound, ok := sList[string(name)]; ok {
+				entrances[string(userID)] = sound
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return sList, entrances, nil
+}
+
+func (s *boltStore) seeded(guildID string) (bool, error) {
+	var seeded bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		guild := tx.Bucket([]byte(guildID))
+		seeded = guild != nil && guild.Get(seededKey) != nil
+		return nil
+	})
+	return seeded, err
+}
+
+func (s *boltStore) seed(guildID string, sList SoundList, entrances Entrances) error {
+	return s.update(guildID, func(sounds *bolt.Bucket, entranceNames *bolt.Bucket) error {
+		for name, sound := range sList {
+			if err := putSound(sounds, name, sound); err != nil {
+				return err
+			}
+		}
+		for userID, sound := range entrances {
+			name, ok := findSoundName(sList, sound)
+			if !ok {
+				continue
+			}
+			if err := entranceNames.Put([]byte(userID), []byte(name)); err != nil {
+				return err
+			}
+		}
+		return sounds.Tx().Bucket([]byte(guildID)).Put(seededKey, []byte("1"))
+	})
+}
+
+func (s *boltStore) AddSound(_ *discordgo.Session, guildID string, name string, sound *Sound) error {
+	return s.update(guildID, func(sounds *bolt.Bucket, _ *bolt.Bucket) error {
+		return putSound(sounds, name, sound)
+	})
+}
+
+func (s *boltStore) DeleteSound(guildID string, name string) error {
+	return s.update(guildID, func(sounds *bolt.Bucket, entranceNames *bolt.Bucket) error {
+		if err := sounds.Delete([]byte(name)); err != nil {
+			return err
+		}
+
+		var orphaned [][]byte
+		err := entranceNames.ForEach(func(userID, entrance []byte) error {
+			if string(entrance) == name {
+				orphaned = append(orphaned, userID)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// bolt doesn't allow deleting keys while iterating
+		for _, userID := range orphaned {
+			if err := entranceNames.Delete(userID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RenameSound only renames the key, the file in discord keeps its original name
+func (s *boltStore) RenameSound(_ *discordgo.Session, guildID string, name string, newName string) (*Sound, error) {
+	var sound *Sound
+	err := s.update(guildID, func(sounds *bolt.Bucket, entranceNames *bolt.Bucket) error {
+		var err error
+		sound, err = getSound(sounds, name)
+		if err != nil {
+			return err
+		}
+		if newName != name && sounds.Get([]byte(newName)) != nil {
+			return fmt.Errorf("%w: %q", errSoundExists, newName)
+		}
+
+		if err := sounds.Delete([]byte(name)); err != nil {
+			return err
+		}
+		if err := putSound(sounds, newName, sound); err != nil {
+			return err
+		}
+
+		return entranceNames.ForEach(func(userID, entrance []byte) error {
+			if string(entrance) == name {
+				return entranceNames.Put(userID, []byte(newName))
+			}
+			return nil
+		})
+	})
+	return sound, err
+}
+
+func (s *boltStore) SetVolume(_ *discordgo.Session, guildID string, name string, volume *int) (*Sound, error) {
+	var sound *Sound
+	err := s.update(guildID, func(sounds *bolt.Bucket, _ *bolt.Bucket) error {
+		var err error
+		sound, err = getSound(sounds, name)
+		if err != nil {
+			return err
+		}
+
+		sound.Volume = volume
+		return putSound(sounds, name, sound)
+	})
+	return sound, err
+}
+
+func (s *boltStore) SetLoudness(_ *discordgo.Session, guildID string, name string, loudness float64, peak float64) (*Sound, error) {
+	var sound *Sound
+	err := s.update(guildID, func(sounds *bolt.Bucket, _ *bolt.Bucket) error {
+		var err error
+		sound, err = getSound(sounds, name)
+		if err != nil {
+			return err
+		}
+
+		sound.Loudness = loudness
+		sound.Peak = peak
+		return putSound(sounds, name, sound)
+	})
+	return sound, err
+}
+
+func (s *boltStore) SetEntrance(_ *discordgo.Session, guildID string, userID string, name string) (*Sound, error) {
+	var sound *Sound
+	err := s.update(guildID, func(sounds *bolt.Bucket, entranceNames *bolt.Bucket) error {
+		var err error
+		sound, err = getSound(sounds, name)
+		if err != nil {
+			return err
+		}
+
+		if string(entranceNames.Get([]byte(userID))) == name {
+			return errAlreadyEntrance
+		}
+		return entranceNames.Put([]byte(userID), []byte(name))
+	})
+	return sound, err
+}
+
+func (s *boltStore) LoadSettings(_ *discordgo.Session, guildID string, _ string) (GuildSettings, error) {
+	var settings GuildSettings
+	err := s.db.View(func(tx *bolt.Tx) error {
+		guild := tx.Bucket([]byte(guildID))
+		if guild == nil {
+			return nil
+		}
+		data := guild.Get(settingsKey)
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &settings)
+	})
+	return settings, err
+}
+
+func (s *boltStore) SaveSettings(_ *discordgo.Session, guildID string, settings GuildSettings) error {
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		guild, err := tx.CreateBucketIfNotExists([]byte(guildID))
+		if err != nil {
+			return err
+		}
+		return guild.Put(settingsKey, data)
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+// update runs fn in a write transaction with the guild's buckets, creating them if needed
+func (s *boltStore) update(guildID string, fn func(sounds *bolt.Bucket, entrances *bolt.Bucket) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		guild, err := tx.CreateBucketIfNotExists([]byte(guildID))
+		if err != nil {
+			return err
+		}
+		err = migrateGuild(guildID, guild)
+		if err != nil {
+			return err
+		}
+
+		sounds, err := guild.CreateBucketIfNotExists(soundsBucket)
+		if err != nil {
+			return err
+		}
+
+		entrances, err := guild.CreateBucketIfNotExists(entrancesBucket)
+		if err != nil {
+			return err
+		}
+
+		return fn(sounds, entrances)
+	})
+}
+
+// migrateGuild brings a guild's bucket up to boltSchema
+func migrateGuild(guildID string, guild *bolt.Bucket) error {
+	schema, _ := strconv.Atoi(string(guild.Get(schemaKey)))
+	if schema >= boltSchema {
+		return nil
+	}
+
+	if sounds := guild.Bucket(soundsBucket); sounds != nil && schema < 2 {
+		migrated := make(SoundList)
+		err := sounds.ForEach(func(name, data []byte) error {
+			sound := &Sound{}
+			if err := json.Unmarshal(data, sound); err != nil {
+				return fmt.Errorf("sound %s: %w", name, err)
+			}
+			if sound.Volume != nil {
+				sound.Volume = metadata.PercentFromDCA(*sound.Volume)
+			}
+			migrated[string(name)] = sound
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// bolt doesn't allow writing keys while iterating
+		for name, sound := range migrated {
+			if err := putSound(sounds, name, sound); err != nil {
+				return err
+			}
+		}
+		if len(migrated) > 0 {
+			slog.Info("migrated sound volumes to percent", "guild", guildID, "sounds", len(migrated))
+		}
+	}
+
+	// guilds from before seededKey have a sounds bucket once they were seeded
+	if guild.Bucket(soundsBucket) != nil && schema < 3 {
+		if err := guild.Put(seededKey, []byte("1")); err != nil {
+			return err
+		}
+	}
+
+	return guild.Put(schemaKey, []byte(strconv.Itoa(boltSchema)))
+}
+
+func getSound(sounds *bolt.Bucket, name string) (*Sound, error) {
+	data := sounds.Get([]byte(name))
+	if data == nil {
+		return nil, fmt.Errorf("%w: %q", errSoundNotFound, name)
+	}
+
+	sound := &Sound{}
+	return sound, json.Unmarshal(data, sound)
+}
+
+func putSound(sounds *bolt.Bucket, name string, sound *Sound) error {
+	data, err := json.Marshal(sound)
+	if err != nil {
+		return err
+	}
+	return sounds.Put([]byte(name), data)
+}
@@ -0,0 +1,93 @@
+package bot
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func newTestBoltStore(t *testing.T) *boltStore {
+	t.Helper()
+
+	s, err := openBoltStore(filepath.Join(t.TempDir(), "sounds.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestBoltRenameSoundKeepsExisting(t *testing.T) {
+	s := newTestBoltStore(t)
+	err := s.seed(testGuildID, SoundList{"a": {MessageID: "1"}, "b": {MessageID: "2"}}, make(Entrances))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.RenameSound(nil, testGuildID, "a", "b")
+	if !errors.Is(err, errSoundExists) {
+		t.Fatalf("renaming onto another sound: %v, want errSoundExists", err)
+	}
+	sList, _, err := s.load(testGuildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sList) != 2 || sList["a"].MessageID != "1" || sList["b"].MessageID != "2" {
+		t.Errorf("sounds after the failed rename: %v", sList)
+	}
+}
+
+func TestBoltSeeded(t *testing.T) {
+	s := newTestBoltStore(t)
+
+	if seeded, _ := s.seeded(testGuildID); seeded {
+		t.Fatal("a new guild is seeded")
+	}
+	// saving settings first doesn't count
+	if err := s.SaveSettings(nil, testGuildID, GuildSettings{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.load(testGuildID); err != nil {
+		t.Fatal(err)
+	}
+	if seeded, _ := s.seeded(testGuildID); seeded {
+		t.Fatal("a guild with only settings is seeded")
+	}
+
+	// a channel without sounds still seeds the guild, it's not read again every load
+	if err := s.seed(testGuildID, make(SoundList), make(Entrances)); err != nil {
+		t.Fatal(err)
+	}
+	if seeded, _ := s.seeded(testGuildID); !seeded {
+		t.Error("a guild seeded with no sounds isn't seeded")
+	}
+}
+
+func TestBoltSeededMigration(t *testing.T) {
+	s := newTestBoltStore(t)
+
+	// a guild seeded before seededKey existed
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		guild, err := tx.CreateBucket([]byte(testGuildID))
+		if err != nil {
+			return err
+		}
+		if err := guild.Put(schemaKey, []byte("2")); err != nil {
+			return err
+		}
+		_, err = guild.CreateBucket(soundsBucket)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := s.load(testGuildID); err != nil {
+		t.Fatal(err)
+	}
+	if seeded, _ := s.seeded(testGuildID); !seeded {
+		t.Error("a guild seeded on schema 2 isn't seeded after migrating")
+	}
+}
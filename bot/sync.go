@@ -0,0 +1,240 @@
+package bot
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/cgoncalveslck/go-api-ebening/bot/metadata"
+)
+
+var maintainOnce sync.Once
+
+// expectedDeletes [MessageID] are sound messages the bot deletes itself (re-uploads and deleteSound), their delete events don't remove anything
+var expectedDeletes sync.Map
+
+func expectDelete(messageID string) {
+	expectedDeletes.Store(messageID, struct{}{})
+}
+
+func maintainStore(d *discordgo.Session) {
+	// the bolt store loads from disk, uploads from while the bot was offline only show up after reconciling
+	if _, ok := backend.(*boltStore); ok {
+		reconcileAll(d)
+	}
+
+	// the store is kept current from gateway events, reconciliation only catches what the events missed
+	reconcileTicker := time.NewTicker(time.Duration(config.RebuildInterval))
+	defer reconcileTicker.Stop()
+	for {
+		select {
+		case <-reconcileTicker.C:
+			reconcileAll(d)
+		case <-shuttingDown:
+			return
+		}
+	}
+}
+
+func reconcileAll(d *discordgo.Session) {
+	for _, guildID := range store.GuildIDs() {
+		err := callRecovered(func() error {
+			return reconcileGuild(d, guildID)
+		})
+		if err != nil {
+			logError("reconciling guild", err, "guild", guildID)
+		}
+	}
+}
+
+// reconcileAttempts is how many times reconcileGuild reads a guild that keeps changing before leaving it for next time
+const reconcileAttempts = 3
+
+// reconcileGuild re-reads the guild from the backend and swaps it in once it's complete,
+// lookups keep using the old sound list until then. A list read while gateway events changed the guild would
+// undo those changes, it's read again instead
+func reconcileGuild(d *discordgo.Session, guildID string) error {
+	gState, err := loadedGuild(guildID)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; attempt <= reconcileAttempts; attempt++ {
+		soundsChannelID := gState.SoundsChannelID()
+		if soundsChannelID == "" {
+			return fmt.Errorf("guild %s: %w", guildID, errNoSoundsChannel)
+		}
+
+		generation := gState.Generation()
+		sList, entrances, err := backend.Reconcile(d, guildID, soundsChannelID)
+		if err != nil {
+			return err
+		}
+
+		previous, ok := gState.ReplaceSounds(sList, entrances, generation)
+		if !ok {
+			slog.Debug("guild changed while reconciling, reading it again", "guild", guildID, "attempt", attempt)
+			continue
+		}
+		added, removed, changed := diffSoundLists(previous, sList)
+		slog.Info("reconciled guild", "guild", guildID, "added", added, "removed", removed, "changed", changed)
+		return nil
+	}
+
+	slog.Warn("guild kept changing while reconciling, trying again next time", "guild", guildID)
+	return nil
+}
+
+// diffSoundLists compares sounds by file, a renamed or re-tagged sound counts as changed
+func diffSoundLists(before SoundList, after SoundList) (int, int, int) {
+	beforeByFile := make(map[string]string, len(before))
+	for name, sound := range before {
+		beforeByFile[sound.fileID()] = name
+	}
+
+	added, changed := 0, 0
+	for name, sound := range after {
+		beforeName, ok := beforeByFile[sound.fileID()]
+		if !ok {
+			added++
+			continue
+		}
+		delete(beforeByFile, sound.fileID())
+
+		if beforeName != name || !sameVolume(before[beforeName].Volume, sound.Volume) || before[beforeName].URL != sound.URL {
+			changed++
+		}
+	}
+
+	return added, len(beforeByFile), changed
+}
+
+// soundsChannelState returns the guild's state if channelID is its sounds channel
+func soundsChannelState(guildID string, channelID string) (*GuildState, bool) {
+	gState, ok := store.Guild(guildID)
+	if !ok || gState.SoundsChannelID() != channelID {
+		return nil, false
+	}
+	return gState, true
+}
+
+// removeSounds drops every sound in a deleted message
+func removeSounds(gState *GuildState, guildID string, messageID string) {
+	if _, ok := expectedDeletes.LoadAndDelete(messageID); ok {
+		return
+	}
+
+	for name, sound := range gState.SoundsInMessage(messageID) {
+		removeSound(gState, guildID, name, sound)
+	}
+}
+
+// removeSound drops a sound whose file is gone
+func removeSound(gState *GuildState, guildID string, name string, sound *Sound) {
+	if gState.RemoveSound(name) == nil {
+		return
+	}
+	forgetSoundFile(sound)
+
+	err := backend.DeleteSound(guildID, name)
+	if err != nil {
+		logError("deleting sound", err, "guild", guildID, "sound", name)
+	}
+	slog.Info("removed sound", "guild", guildID, "sound", name)
+}
+
+func messageDeleteHandler(d *discordgo.Session, m *discordgo.MessageDelete) {
+	gState, ok := soundsChannelState(m.GuildID, m.ChannelID)
+	if !ok {
+		return
+	}
+	removeSounds(gState, m.GuildID, m.ID)
+}
+
+func messageDeleteBulkHandler(d *discordgo.Session, m *discordgo.MessageDeleteBulk) {
+	gState, ok := soundsChannelState(m.GuildID, m.ChannelID)
+	if !ok {
+		return
+	}
+	for _, messageID := range m.Messages {
+		removeSounds(gState, m.GuildID, messageID)
+	}
+}
+
+// messageUpdateHandler picks up edits to sound messages, an edit that removes a file removes its sound
+// and with the discord store an edit to the metadata changes the sound's volume and entrances
+func messageUpdateHandler(d *discordgo.Session, m *discordgo.MessageUpdate) {
+	gState, ok := soundsChannelState(m.GuildID, m.ChannelID)
+	if !ok {
+		return
+	}
+
+	sounds := gState.SoundsInMessage(m.ID)
+	if m.Attachments != nil {
+		for name, sound := range sounds {
+			if !hasAttachment(m.Attachments, sound) {
+				removeSound(gState, m.GuildID, name, sound)
+				delete(sounds, name)
+			}
+		}
+	}
+
+	// only the bot's messages have metadata, they have one sound
+	if _, ok := backend.(*discordStore); !ok || len(sounds) != 1 {
+		return
+	}
+
+	meta, err := metadata.Decode(m.Content)
+	if err != nil {
+		slog.Warn("ignoring sound metadata", "message", m.ID, "err", err)
+		return
+	}
+	for name, sound := range sounds {
+		updatedSound := *sound
+		updatedSound.Volume = meta.Volume
+		if meta.Loudness != 0 {
+			updatedSound.Loudness = meta.Loudness
+			updatedSound.Peak = meta.Peak
+		}
+		gState.UpdateSound(name, &updatedSound, meta.Entrances)
+	}
+}
+
+// hasAttachment is true if the sound's file is one of attachments
+func hasAttachment(attachments []*discordgo.MessageAttachment, sound *Sound) bool {
+	id := attachmentID(sound.URL)
+	if id == "" {
+		// a URL without an ID can't be matched, only no files at all means it's gone
+		return len(attachments) > 0
+	}
+	for _, attachment := range attachments {
+		if attachment.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// channelUpdateHandler follows the sounds channel when a channel gets renamed to (or away from) config.SoundsChannel
+func channelUpdateHandler(d *discordgo.Session, c *discordgo.ChannelUpdate) {
+	gState, ok := store.Guild(c.GuildID)
+	if !ok {
+		return
+	}
+
+	soundsChannelID := gState.SoundsChannelID()
+	if c.ID == soundsChannelID && c.Name != config.SoundsChannel {
+		slog.Warn("sounds channel was renamed, keeping it until a new one shows up", "guild", c.GuildID, "name", c.Name)
+		return
+	}
+
+	if c.ID != soundsChannelID && c.Name == config.SoundsChannel {
+		gState.SetSoundsChannelID(c.ID)
+		err := reconcileGuild(d, c.GuildID)
+		if err != nil {
+			logError("reconciling guild", err, "guild", c.GuildID)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package bot
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// an upload of two files, both are in message m
+var (
+	uploadedA = &Sound{MessageID: "m", URL: "https://cdn.discordapp.com/attachments/c/a1/a.mp3"}
+	uploadedB = &Sound{MessageID: "m", URL: "https://cdn.discordapp.com/attachments/c/a2/b.mp3"}
+)
+
+func TestDiffSoundListsByFile(t *testing.T) {
+	before := SoundList{"a": uploadedA}
+	after := SoundList{"a": uploadedA, "b": uploadedB}
+
+	added, removed, changed := diffSoundLists(before, after)
+	if added != 1 || removed != 0 || changed != 0 {
+		t.Errorf("adding the second file of an upload = %d added, %d removed, %d changed", added, removed, changed)
+	}
+	added, removed, changed = diffSoundLists(after, before)
+	if added != 0 || removed != 1 || changed != 0 {
+		t.Errorf("removing the second file of an upload = %d added, %d removed, %d changed", added, removed, changed)
+	}
+}
+
+func TestHasAttachment(t *testing.T) {
+	attachments := []*discordgo.MessageAttachment{{ID: "a2"}}
+	if hasAttachment(attachments, uploadedA) {
+		t.Error("a is still in a message that only has a2")
+	}
+	if !hasAttachment(attachments, uploadedB) {
+		t.Error("b isn't in a message that has a2")
+	}
+
+	noID := &Sound{MessageID: "m", URL: "https://cdn.example/sound.mp3"}
+	if !hasAttachment(attachments, noID) || hasAttachment(nil, noID) {
+		t.Error("a sound without an attachment ID should only be gone with every file")
+	}
+}
+
+func TestSoundsInMessage(t *testing.T) {
+	gState := newTestGuild(t, 2)
+	gState.AddSound("a", uploadedA)
+	gState.AddSound("b", uploadedB)
+
+	sList := gState.SoundsInMessage("m")
+	if len(sList) != 2 || sList["a"] != uploadedA || sList["b"] != uploadedB {
+		t.Errorf("SoundsInMessage = %v, want a and b", sList)
+	}
+}
+
+func TestKeepMeasurementsByFile(t *testing.T) {
+	gState := newTestGuild(t, 0)
+	measuredA := *uploadedA
+	measuredA.Loudness, measuredA.Hash = -20, "hash of a"
+	gState.AddSound("a", &measuredA)
+	gState.AddSound("b", uploadedB)
+
+	loadedA, loadedB := *uploadedA, *uploadedB
+	keepMeasurements(gState, SoundList{"a": &loadedA, "b": &loadedB})
+	if loadedA.Loudness != -20 || loadedA.Hash != "hash of a" {
+		t.Errorf("a lost its measurements: %+v", loadedA)
+	}
+	if loadedB.Loudness != 0 || loadedB.Hash != "" {
+		t.Errorf("b got a's measurements: %+v", loadedB)
+	}
+}
@@ -0,0 +1,386 @@
+package bot
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/cgoncalveslck/go-api-ebening/bot/metadata"
+)
+
+// uploadLimit is Discord's upload limit for a bot in a server without boosts
+const uploadLimit = 10 << 20
+
+const (
+	// maxZipSize is the biggest zip that gets downloaded at all
+	maxZipSize    = 100 << 20
+	maxZipEntries = 500
+	// maxZipUncompressed is the most that gets extracted from a single zip
+	maxZipUncompressed = 500 << 20
+	// maxZipEntrySize is as big as a single sound can be, anything bigger couldn't be re-uploaded anyway
+	maxZipEntrySize = uploadLimit
+	// maxZipRatio is how much an entry can expand before it's treated as a zip bomb
+	maxZipRatio = 100
+	// zipProgressEvery is how many entries go by between progress message edits
+	zipProgressEvery = 10
+)
+
+// zipReport is what happened to each entry of an imported zip
+type zipReport struct {
+	fileName string
+	total    int
+	imported []string
+	// renamed [FileName] -> SoundName, for sounds whose name was already taken
+	renamed map[string]string
+	// restored is how many sounds got their volume/entrances back from an export's manifest
+	restored int
+	skipped  []string
+	failed   []string
+}
+
+func (r *zipReport) skip(fileName string, reason string) {
+	r.skipped = append(r.skipped, fileName+" ("+reason+")")
+}
+
+func (r *zipReport) fail(fileName string, reason string) {
+	r.failed = append(r.failed, fileName+" ("+reason+")")
+}
+
+func (r *zipReport) progress() string {
+	done := len(r.imported) + len(r.skipped) + len(r.failed)
+	return fmt.Sprintf("Importing %s: %d/%d", r.fileName, done, r.total)
+}
+
+// summary is the final report, cut short to fit in a Discord message
+func (r *zipReport) summary() string {
+	output := fmt.Sprintf("Imported %d of %d files from %s", len(r.imported), r.total, r.fileName)
+	if r.restored > 0 {
+		output += fmt.Sprintf("\nRestored the volume and entrances of %d sounds from the manifest", r.restored)
+	}
+	output += formatZipList("Renamed (name taken)", renamedList(r.renamed))
+	output += formatZipList("Skipped", r.skipped)
+	output += formatZipList("Failed", r.failed)
+	return output
+}
+
+func renamedList(renamed map[string]string) []string {
+	list := make([]string, 0, len(renamed))
+	for fileName, name := range renamed {
+		list = append(list, fileName+" -> "+name)
+	}
+	return list
+}
+
+func formatZipList(title string, items []string) string {
+	if len(items) == 0 {
+		return ""
+	}
+	output := "\n" + title + ":\n"
+	for i, item := range items {
+		line := "- " + item + "\n"
+		// each list gets a share of Discord's 2000 character limit
+		if len(output)+len(line) > 600 {
+			output += fmt.Sprintf("... and %d more\n", len(items)-i)
+			break
+		}
+		output += line
+	}
+	return output
+}
+
+// handleZipUpload re-uploads every sound in the zip to the sounds channel as its own message, then deletes the zip
+// a progress message is kept up to date while it runs and ends up as the summary
+// zips made by ,export have a manifest, their sounds get their names, volumes and entrances back
+func handleZipUpload(d *discordgo.Session, uMsg *discordgo.MessageCreate, attachment *discordgo.MessageAttachment) error {
+	gState, err := loadedGuild(uMsg.GuildID)
+	if err != nil {
+		return err
+	}
+	if attachment.Size > maxZipSize {
+		return userErrorf("%s is too big, zips can be up to %d MB", attachment.Filename, maxZipSize>>20)
+	}
+
+	archive, cleanup, err := downloadZip(attachment.URL)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	manifest, err := readManifest(archive)
+	if err != nil {
+		return &userError{msg: "The zip's " + manifestName + " couldn't be read, remove it to import the sounds without their metadata", cause: err}
+	}
+
+	files, err := zipFiles(archive, attachment.Filename)
+	if err != nil {
+		return err
+	}
+
+	report := &zipReport{fileName: attachment.Filename, total: len(files), renamed: make(map[string]string)}
+	progressMsg, err := d.ChannelMessageSendReply(uMsg.ChannelID, report.progress(), uMsg.Reference())
+	if err != nil {
+		return fmt.Errorf("sending progress message: %w", err)
+	}
+
+	var extracted int64
+	for i, file := range files {
+		if isShuttingDown() {
+			report.fail(file.Name, "the bot restarted")
+			continue
+		}
+
+		data, reason := readZipEntry(file, maxZipUncompressed-extracted)
+		if reason != "" {
+			report.skip(file.Name, reason)
+		} else {
+			extracted += int64(len(data))
+			importZipEntry(d, uMsg, gState, file.Name, data, manifest[file.Name], report)
+		}
+
+		if (i+1)%zipProgressEvery == 0 {
+			_, err = d.ChannelMessageEdit(uMsg.ChannelID, progressMsg.ID, report.progress())
+			if err != nil {
+				logError("updating zip progress", err, "guild", uMsg.GuildID)
+			}
+		}
+	}
+
+	slog.Info("imported zip", "guild", uMsg.GuildID, "file", attachment.Filename,
+		"imported", len(report.imported), "skipped", len(report.skipped), "failed", len(report.failed))
+
+	_, err = d.ChannelMessageEdit(uMsg.ChannelID, progressMsg.ID, report.summary())
+	if err != nil {
+		logError("sending zip summary", err, "guild", uMsg.GuildID)
+	}
+	return d.ChannelMessageDelete(uMsg.ChannelID, uMsg.ID)
+}
+
+// zipFiles returns the files in the archive that could be sounds, as long as the zip is within the limits
+func zipFiles(archive *zip.Reader, zipName string) ([]*zip.File, error) {
+	var files []*zip.File
+	var declared uint64
+	for _, file := range archive.File {
+		if file.FileInfo().IsDir() || file.Name == manifestName {
+			continue
+		}
+		files = append(files, file)
+		declared += file.UncompressedSize64
+	}
+	if len(files) > maxZipEntries {
+		return nil, userErrorf("%s has %d files, zips can have up to %d", zipName, len(files), maxZipEntries)
+	}
+	if declared > maxZipUncompressed {
+		return nil, userErrorf("%s is %d MB extracted, zips can be up to %d MB extracted", zipName, declared>>20, maxZipUncompressed>>20)
+	}
+	return files, nil
+}
+
+// downloadZip saves the zip to a temp file, cleanup removes it
+func downloadZip(url string) (*zip.Reader, func(), error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, nil, failed("Couldn't download the zip", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, failed("Couldn't download the zip", fmt.Errorf("downloading zip: %s", resp.Status))
+	}
+
+	tmp, err := os.CreateTemp("", "ebening-*.zip")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+
+	size, err := io.Copy(tmp, io.LimitReader(resp.Body, maxZipSize+1))
+	if err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("downloading zip: %w", err)
+	}
+	if size > maxZipSize {
+		cleanup()
+		return nil, nil, userErrorf("That zip is too big, zips can be up to %d MB", maxZipSize>>20)
+	}
+
+	archive, err := zip.NewReader(tmp, size)
+	if err != nil {
+		cleanup()
+		return nil, nil, &userError{msg: "That zip couldn't be opened", cause: err}
+	}
+	return archive, cleanup, nil
+}
+
+// readZipEntry extracts a sound file, reason says why it was skipped
+// sizes in the zip's headers can lie so what's actually read is checked too, never more than budget bytes
+func readZipEntry(file *zip.File, budget int64) ([]byte, string) {
+	base := path.Base(file.Name)
+	if strings.HasPrefix(file.Name, "__MACOSX/") || strings.HasPrefix(base, ".") {
+		return nil, "hidden file"
+	}
+	if _, _, ok := soundFile(base); !ok {
+		return nil, "unsupported format"
+	}
+	if file.UncompressedSize64 > maxZipEntrySize {
+		return nil, fmt.Sprintf("bigger than %d MB", maxZipEntrySize>>20)
+	}
+	if file.CompressedSize64 > 0 && file.UncompressedSize64/file.CompressedSize64 > maxZipRatio {
+		return nil, "suspicious compression"
+	}
+
+	reader, err := file.Open()
+	if err != nil {
+		return nil, "couldn't be read"
+	}
+	defer reader.Close()
+
+	limit := min(int64(maxZipEntrySize), budget)
+	data, err := io.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, "couldn't be read"
+	}
+	if int64(len(data)) > limit {
+		return nil, "bigger than it claims to be"
+	}
+	return data, ""
+}
+
+// importZipEntry uploads one sound and adds it under a free name, the sound points at its own message
+// restore is the sound's entry in the manifest, empty if it has none
+func importZipEntry(d *discordgo.Session, uMsg *discordgo.MessageCreate, gState *GuildState, fileName string, data []byte, restore exportedSound, report *zipReport) {
+	name, format := zipSoundName(fileName, restore)
+	if !validSoundName(name) {
+		report.skip(fileName, "invalid name")
+		return
+	}
+
+	hash, err := hashReader(bytes.NewReader(data))
+	if err != nil {
+		report.fail(fileName, "couldn't be read")
+		return
+	}
+	if duplicate := findDuplicate(d, gState, &Sound{Size: len(data), Hash: hash}); duplicate != "" {
+		report.skip(fileName, "same file as "+duplicate)
+		return
+	}
+
+	err = checkSize(len(data))
+	if err != nil {
+		report.skip(fileName, userMessage(err))
+		return
+	}
+	info, err := analyzeData(context.Background(), data, format)
+	if err != nil {
+		logError("analyzing zip entry", err, "guild", uMsg.GuildID, "file", fileName)
+		report.skip(fileName, "couldn't be read as audio")
+		return
+	}
+	err = checkAudio(info)
+	if err != nil {
+		report.skip(fileName, userMessage(err))
+		return
+	}
+
+	// the bot's own message can carry the loudness, so it doesn't have to be measured again after a restart
+	soundName := freeSoundName(gState, name)
+	meta := metadata.Metadata{Loudness: info.Loudness, Peak: info.Peak}
+	soundMessage, err := d.ChannelMessageSendComplex(uMsg.ChannelID, &discordgo.MessageSend{
+		Content: meta.Encode(),
+		Files:   []*discordgo.File{{Name: soundName + "." + format, Reader: bytes.NewReader(data)}},
+	})
+	if err != nil {
+		logError("uploading zip entry", err, "guild", uMsg.GuildID, "file", fileName)
+		report.fail(fileName, "upload failed")
+		return
+	}
+	if len(soundMessage.Attachments) == 0 {
+		report.fail(fileName, "upload failed")
+		return
+	}
+
+	sound := &Sound{
+		MessageID: soundMessage.ID,
+		URL:       soundMessage.Attachments[0].URL,
+		Format:    format,
+		Size:      len(data),
+		Hash:      hash,
+		Loudness:  info.Loudness,
+		Peak:      info.Peak,
+	}
+	err = addSound(d, uMsg.GuildID, gState, soundName, sound)
+	if err != nil {
+		logError("saving sound", err, "guild", uMsg.GuildID, "sound", soundName)
+		report.fail(fileName, "couldn't be saved")
+		return
+	}
+
+	report.imported = append(report.imported, soundName)
+	if soundName != name {
+		report.renamed[fileName] = soundName
+	}
+
+	if restore.Volume == nil && len(restore.Entrances) == 0 {
+		return
+	}
+	err = restoreMetadata(d, uMsg.GuildID, gState, soundName, restore)
+	if err != nil {
+		logError("restoring sound metadata", err, "guild", uMsg.GuildID, "sound", soundName)
+		report.fail(fileName, "imported, but its volume/entrances couldn't be restored")
+		return
+	}
+	report.restored++
+}
+
+// zipSoundName is what an entry is called as a sound, the name it had when it was exported if it's in the manifest
+// spaces become underscores, the name still has to pass validSoundName
+func zipSoundName(fileName string, restore exportedSound) (string, string) {
+	name, format, _ := soundFile(path.Base(fileName))
+	if restore.Name != "" {
+		name = restore.Name
+	}
+	return strings.Join(strings.Fields(name), "_"), format
+}
+
+// restoreMetadata sets an imported sound's volume and entrances from the manifest,
+// users that already have an entrance in this guild keep theirs
+func restoreMetadata(d *discordgo.Session, guildID string, gState *GuildState, name string, restore exportedSound) error {
+	if restore.Volume != nil {
+		_, err := setSoundVolume(d, guildID, gState, name, restore.Volume)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, userID := range restore.Entrances {
+		if _, ok := gState.Entrance(userID); ok {
+			continue
+		}
+		_, err := setEntrance(d, guildID, gState, userID, name)
+		if err != nil && !errors.Is(err, errAlreadyEntrance) {
+			return err
+		}
+	}
+	return nil
+}
+
+// freeSoundName is name, or name-2, name-3... if it's taken
+func freeSoundName(gState *GuildState, name string) string {
+	candidate := name
+	for i := 2; ; i++ {
+		if _, taken := gState.Sound(candidate); !taken {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s-%d", name, i)
+	}
+}
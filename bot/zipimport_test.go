@@ -0,0 +1,153 @@
+package bot
+
+import (
+	"archive/zip"
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+// testZip builds a zip in memory
+func testZip(t *testing.T, build func(zw *zip.Writer)) *zip.Reader {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	build(zw)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+func writeZipFile(t *testing.T, zw *zip.Writer, name string, method uint16, data []byte) {
+	t.Helper()
+
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestZipFiles(t *testing.T) {
+	archive := testZip(t, func(zw *zip.Writer) {
+		writeZipFile(t, zw, "sounds/", zip.Store, nil)
+		writeZipFile(t, zw, manifestName, zip.Store, []byte("{}"))
+		writeZipFile(t, zw, "sounds/a.mp3", zip.Store, []byte("a"))
+		writeZipFile(t, zw, "b.ogg", zip.Store, []byte("b"))
+	})
+	files, err := zipFiles(archive, "sounds.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Name != "sounds/a.mp3" || files[1].Name != "b.ogg" {
+		t.Errorf("zipFiles kept %d files, want sounds/a.mp3 and b.ogg", len(files))
+	}
+
+	tooMany := testZip(t, func(zw *zip.Writer) {
+		for i := 0; i <= maxZipEntries; i++ {
+			writeZipFile(t, zw, strconv.Itoa(i)+".mp3", zip.Store, nil)
+		}
+	})
+	if _, err := zipFiles(tooMany, "sounds.zip"); err == nil {
+		t.Errorf("zipFiles accepted %d files", maxZipEntries+1)
+	}
+
+	// only the headers are read, they can claim more than is in the zip
+	tooBig := testZip(t, func(zw *zip.Writer) {
+		for i := 0; i < 2; i++ {
+			header := &zip.FileHeader{Name: strconv.Itoa(i) + ".mp3", Method: zip.Store, UncompressedSize64: maxZipUncompressed/2 + 1}
+			if _, err := zw.CreateRaw(header); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	if _, err := zipFiles(tooBig, "sounds.zip"); err == nil {
+		t.Errorf("zipFiles accepted more than %d MB extracted", maxZipUncompressed>>20)
+	}
+}
+
+func TestReadZipEntry(t *testing.T) {
+	sound := []byte("not really an mp3")
+	archive := testZip(t, func(zw *zip.Writer) {
+		writeZipFile(t, zw, "ok.mp3", zip.Deflate, sound)
+		writeZipFile(t, zw, ".hidden.mp3", zip.Store, sound)
+		writeZipFile(t, zw, "__MACOSX/ok.mp3", zip.Store, sound)
+		writeZipFile(t, zw, "notes.txt", zip.Store, sound)
+		writeZipFile(t, zw, "noname", zip.Store, sound)
+		writeZipFile(t, zw, "huge.mp3", zip.Store, make([]byte, maxZipEntrySize+1))
+		writeZipFile(t, zw, "bomb.mp3", zip.Deflate, make([]byte, 1<<20))
+	})
+	entries := make(map[string]*zip.File)
+	for _, file := range archive.File {
+		entries[file.Name] = file
+	}
+
+	data, reason := readZipEntry(entries["ok.mp3"], maxZipUncompressed)
+	if reason != "" || !bytes.Equal(data, sound) {
+		t.Errorf("readZipEntry(ok.mp3) = %q, %q, want the sound", data, reason)
+	}
+
+	skipped := map[string]string{
+		".hidden.mp3":     "hidden file",
+		"__MACOSX/ok.mp3": "hidden file",
+		"notes.txt":       "unsupported format",
+		"noname":          "unsupported format",
+		"huge.mp3":        "bigger than 10 MB",
+		"bomb.mp3":        "suspicious compression",
+	}
+	for name, want := range skipped {
+		if data, reason := readZipEntry(entries[name], maxZipUncompressed); reason != want || data != nil {
+			t.Errorf("readZipEntry(%s) = %d bytes, %q, want %q", name, len(data), reason, want)
+		}
+	}
+
+	// what's left of the budget is less than the entry really is
+	if data, reason := readZipEntry(entries["ok.mp3"], int64(len(sound)-1)); reason != "bigger than it claims to be" || data != nil {
+		t.Errorf("readZipEntry over budget = %d bytes, %q", len(data), reason)
+	}
+}
+
+func TestZipSoundName(t *testing.T) {
+	tests := []struct {
+		fileName string
+		restore  exportedSound
+		name     string
+		format   string
+	}{
+		{"airhorn.mp3", exportedSound{}, "airhorn", "mp3"},
+		{"sounds/big airhorn.ogg", exportedSound{}, "big_airhorn", "ogg"},
+		{"sounds/a  b\tc.wav", exportedSound{}, "a_b_c", "wav"},
+		{"sounds/airhorn-2.mp3", exportedSound{Name: "airhorn"}, "airhorn", "mp3"},
+		{"sounds/x.opus", exportedSound{Name: "old name"}, "old_name", "opus"},
+	}
+	for _, tt := range tests {
+		name, format := zipSoundName(tt.fileName, tt.restore)
+		if name != tt.name || format != tt.format {
+			t.Errorf("zipSoundName(%q, %q) = %q, %q, want %q, %q", tt.fileName, tt.restore.Name, name, format, tt.name, tt.format)
+		}
+	}
+}
+
+func TestFreeSoundName(t *testing.T) {
+	gState := newTestGuild(t, 2)
+	gState.AddSound("sound0-2", &Sound{MessageID: "m2"})
+
+	tests := map[string]string{
+		"new":    "new",
+		"sound1": "sound1-2",
+		"sound0": "sound0-3",
+	}
+	for name, want := range tests {
+		if got := freeSoundName(gState, name); got != want {
+			t.Errorf("freeSoundName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
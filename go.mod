@@ -5,6 +5,7 @@ go 1.22.5
 require (
 	github.com/bwmarrin/discordgo v0.28.1
 	github.com/cgoncalveslck/dcalck v0.0.0-20240903000900-722d1000facd
+	go.etcd.io/bbolt v1.3.11
 )
 
 require (
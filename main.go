@@ -1,15 +1,23 @@
 package main
 
 import (
+	"log/slog"
 	"os"
 
 	"github.com/cgoncalveslck/go-api-ebening/bot"
 )
 
 func main() {
-	bot.Token = os.Getenv("BOT_TOKEN")
-	if bot.Token == "" {
-		panic("BOT_TOKEN environment variable is required")
+	// CONFIG_FILE is optional, the environment alone is enough (see bot.Config)
+	cfg, err := bot.LoadConfig(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		slog.Error("invalid config", "err", err)
+		os.Exit(1)
+	}
+
+	err = bot.Run(cfg)
+	if err != nil {
+		slog.Error("bot stopped", "err", err)
+		os.Exit(1)
 	}
-	bot.Run()
 }